@@ -0,0 +1,422 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+)
+
+const AuditTable = "audit_log"
+
+//go:embed migrations/audit
+var auditMigrations embed.FS
+
+// AuditMigrations holds the migration creating AuditTable on postgres, copy it into your migrations
+// under your own version or run it with CreateAuditTable
+var AuditMigrations, _ = fs.Sub(auditMigrations, "migrations/audit")
+
+type AuditOp string
+
+const (
+	AuditInsert AuditOp = "INSERT"
+	AuditUpdate AuditOp = "UPDATE"
+	AuditDelete AuditOp = "DELETE"
+)
+
+type AuditConfig struct {
+	// PKs identify a row in its history, default id
+	PKs []string
+	// Ignore are columns left out of the diff of updates, e.g. updated_at
+	Ignore []string
+}
+
+func (c *AuditConfig) SetDefault() {
+	if len(c.PKs) == 0 {
+		c.PKs = []string{"id"}
+	}
+}
+
+// AuditEntry is one change of one row, Before and After hold the changed columns of an update
+// and the whole row of an insert or delete
+type AuditEntry struct {
+	ID     int64           `db:"id" json:"id"`
+	Table  string          `db:"table_name" json:"table"`
+	PK     json.RawMessage `db:"pk" json:"pk"`
+	Op     AuditOp         `db:"op" json:"op"`
+	Before json.RawMessage `db:"before" json:"before"`
+	After  json.RawMessage `db:"after" json:"after"`
+	Actor  string          `db:"actor" json:"actor"`
+	At     time.Time       `db:"at" json:"at"`
+}
+
+var audits = newTableRegistry[AuditConfig]()
+
+// RegisterAudit makes Create, CreateMany, UpdateM, UpdateWithID, UpsertMany, Delete, the soft delete
+// helpers, CopyUpsert and Repository on table record their changes in AuditTable, in the same
+// transaction as the change. The actor is taken from WithUser.
+// A *sqlx.DB runner starts a transaction per call, a *sqlx.Tx runner uses a savepoint of it.
+func RegisterAudit(table string, cfg AuditConfig) {
+	cfg.SetDefault()
+	audits.register(table, cfg)
+}
+
+type auditingKey struct{}
+
+// auditOf returns the config of table, unless ctx is the one of a write already being audited
+func auditOf(ctx context.Context, table string) (AuditConfig, bool) {
+	if auditing, _ := ctx.Value(auditingKey{}).(bool); auditing {
+		return AuditConfig{}, false
+	}
+	return audits.get(table)
+}
+
+// CreateAuditTable runs the shipped migration, it is idempotent
+func CreateAuditTable(ctx context.Context, con sqlx.ExecerContext) error {
+	ddl, err := fs.ReadFile(AuditMigrations, "1_audit_log.up.sql")
+	if err != nil {
+		return err
+	}
+	_, err = con.ExecContext(ctx, string(ddl))
+	return err
+}
+
+func AuditHistory(log zerolog.Logger, con sqlx.QueryerContext, table string, pk map[string]any) ([]AuditEntry, error) {
+	return AuditHistoryCtx(context.Background(), log, con, table, pk)
+}
+
+// AuditHistoryCtx returns the changes of the row of table identified by pk, oldest first
+func AuditHistoryCtx(ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, table string, pk map[string]any) (ret []AuditEntry, err error) {
+	ctx, span := startDBSpan(ctx, con, "SELECT", AuditTable)
+	defer func() { endSpan(span, err) }()
+	ret = []AuditEntry{}
+	key, err := json.Marshal(pk)
+	if err != nil {
+		return
+	}
+	q := PostgresDialect.Builder().Select("id", "table_name", "pk", "op", "before", "after", "actor", "at").
+		From(AuditTable).
+		Where(sq.Eq{"table_name": table}).
+		Where("pk = ?::jsonb", string(key)).
+		OrderBy("at", "id")
+	spanStatement(span, q)
+	query, args, _ := q.ToSql()
+	if err = selectContext(ctx, con, &ret, query, args...); err != nil {
+		log.Err(err).Str("table", table).Interface("pk", pk).Msg("error get audit history")
+	}
+	return
+}
+
+func auditActor(ctx context.Context) string {
+	user, ok := UserFromCtx(ctx)
+	if !ok {
+		return ""
+	}
+	if user.Email != "" {
+		return user.Email
+	}
+	return user.Username
+}
+
+// audited runs write in a transaction of con and records how the rows matched by where changed,
+// where is a list of conditions each read on its own so a long one can be split under the placeholder limit.
+// When where may stop matching the rows it changed, as for updates, the rows are looked up again
+// by their primary keys, sameRows keeps where for writes keyed on the primary keys like upserts.
+func audited(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, cfg AuditConfig,
+	where []sq.Sqlizer, sameRows bool, write func(ctx context.Context, tx TxRunner) error) error {
+	if err := DialectOf(con).Check(FeatureReturning); err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, auditingKey{}, true)
+	return WithTxRunner(ctx, con, TxOptions{}, func(tx TxRunner) (err error) {
+		before, err := auditRows(ctx, tx, table, where, true)
+		if err != nil {
+			return
+		}
+		if err = write(ctx, tx); err != nil {
+			return
+		}
+		if !sameRows {
+			where = cfg.pkIn(before)
+		}
+		after, err := auditRows(ctx, tx, table, where, false)
+		if err != nil {
+			return
+		}
+		if err = writeAudit(ctx, tx, table, cfg, before, after); err != nil {
+			log.Err(err).Str("table", table).Msg("error write audit")
+		}
+		return
+	})
+}
+
+// auditedCreate inserts the rows returning them whole, as there is nothing to look them up by before.
+// ids holds the returning column of every row, as CreateManySkipCtx does.
+func auditedCreate(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, cfg AuditConfig,
+	base sq.InsertBuilder, returning []string) (ids []int, err error) {
+	after, err := auditedInsert(ctx, log, con, table, cfg, base)
+	if err != nil || len(returning) == 0 {
+		return
+	}
+	for _, row := range after {
+		id, _ := auditPKValue(row[returning[0]]).(int64)
+		ids = append(ids, int(id))
+	}
+	return
+}
+
+// auditedInsert runs base in a transaction of con and records the inserted rows, which it returns
+func auditedInsert(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, cfg AuditConfig,
+	base sq.InsertBuilder) (after []map[string]any, err error) {
+	if err = DialectOf(con).Check(FeatureReturning); err != nil {
+		return
+	}
+	ctx = context.WithValue(ctx, auditingKey{}, true)
+	err = WithTxRunner(ctx, con, TxOptions{}, func(tx TxRunner) (err error) {
+		query, args, _ := base.Suffix("RETURNING to_jsonb(" + auditRowRef(table) + ")").ToSql()
+		if after, err = queryAuditRows(ctx, tx, query, args); err != nil {
+			log.Err(err).Str("query", query).Msg("error create many")
+			return
+		}
+		if err = writeAudit(ctx, tx, table, cfg, nil, after); err != nil {
+			log.Err(err).Str("table", table).Msg("error write audit")
+		}
+		return
+	})
+	return
+}
+
+// auditRowRef is the whole row reference of table, a schema qualified table is referenced by its name
+func auditRowRef(table string) string {
+	ref := PostgresDialect.Ident(table)
+	return ref[strings.LastIndex(ref, ".")+1:]
+}
+
+// auditRows reads the rows matched by each of wheres, one statement each
+func auditRows(ctx context.Context, tx TxRunner, table string, wheres []sq.Sqlizer, lock bool) (ret []map[string]any, err error) {
+	for _, where := range wheres {
+		b := PostgresDialect.Builder().Select("to_jsonb(" + auditRowRef(table) + ")").From(PostgresDialect.Ident(table)).Where(where)
+		if lock {
+			b = b.Suffix("FOR UPDATE")
+		}
+		query, args, err := b.ToSql()
+		if err != nil {
+			return nil, err
+		}
+		rows, err := queryAuditRows(ctx, tx, query, args)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, rows...)
+	}
+	return
+}
+
+func queryAuditRows(ctx context.Context, tx TxRunner, query string, args []any) (ret []map[string]any, err error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var raw []byte
+		if err = rows.Scan(&raw); err != nil {
+			return
+		}
+		row, err := decodeAuditRow(raw)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, row)
+	}
+	err = rows.Err()
+	return
+}
+
+// decodeAuditRow decodes the to_jsonb of a row keeping the numbers exact
+func decodeAuditRow(raw []byte) (row map[string]any, err error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err = dec.Decode(&row)
+	return
+}
+
+// pk is the primary key of row, its json is the pk column of AuditTable
+func (c AuditConfig) pk(row map[string]any) map[string]any {
+	ret := make(map[string]any, len(c.PKs))
+	for _, col := range c.PKs {
+		ret[col] = row[col]
+	}
+	return ret
+}
+
+// pkIn selects rows by the primary keys of rows, in batches binding at most PostgresPlaceholderLimit values
+func (c AuditConfig) pkIn(rows []map[string]any) (ret []sq.Sqlizer) {
+	for batch := range slices.Chunk(rows, PostgresPlaceholderLimit/len(c.PKs)) {
+		if len(c.PKs) == 1 {
+			vals := make([]any, len(batch))
+			for i, row := range batch {
+				vals[i] = auditPKValue(row[c.PKs[0]])
+			}
+			ret = append(ret, sq.Eq{c.PKs[0]: vals})
+			continue
+		}
+		or := sq.Or{}
+		for _, row := range batch {
+			eq := sq.Eq{}
+			for _, col := range c.PKs {
+				eq[col] = auditPKValue(row[col])
+			}
+			or = append(or, eq)
+		}
+		ret = append(ret, or)
+	}
+	return
+}
+
+// auditPKValue turns the numbers of the decoded rows back into something the drivers bind
+func auditPKValue(v any) any {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
+
+// auditDiff keeps the columns changed between before and after
+func auditDiff(before, after map[string]any, ignore []string) (b, a map[string]any) {
+	b, a = map[string]any{}, map[string]any{}
+	for col, v := range after {
+		if Contains(col, ignore) {
+			continue
+		}
+		if old, ok := before[col]; !ok || !reflect.DeepEqual(old, v) {
+			b[col], a[col] = before[col], v
+		}
+	}
+	for col, v := range before {
+		if _, ok := after[col]; !ok && !Contains(col, ignore) {
+			b[col], a[col] = v, nil
+		}
+	}
+	return
+}
+
+type auditChange struct {
+	pk            string
+	op            AuditOp
+	before, after map[string]any
+}
+
+// auditChanges pairs the rows by primary key, in the order they were read
+func auditChanges(cfg AuditConfig, before, after []map[string]any) (ret []auditChange, err error) {
+	var changes []*auditChange
+	byPK := map[string]*auditChange{}
+	get := func(row map[string]any) (*auditChange, error) {
+		key, err := json.Marshal(cfg.pk(row))
+		if err != nil {
+			return nil, err
+		}
+		c, ok := byPK[string(key)]
+		if !ok {
+			c = &auditChange{pk: string(key)}
+			byPK[c.pk] = c
+			changes = append(changes, c)
+		}
+		return c, nil
+	}
+	for _, row := range before {
+		c, e := get(row)
+		if e != nil {
+			return nil, e
+		}
+		c.before = row
+	}
+	for _, row := range after {
+		c, e := get(row)
+		if e != nil {
+			return nil, e
+		}
+		c.after = row
+	}
+
+	for _, c := range changes {
+		switch {
+		case c.before == nil:
+			c.op = AuditInsert
+		case c.after == nil:
+			c.op = AuditDelete
+		default:
+			c.op = AuditUpdate
+			if c.before, c.after = auditDiff(c.before, c.after, cfg.Ignore); len(c.after) == 0 {
+				continue
+			}
+		}
+		ret = append(ret, *c)
+	}
+	return
+}
+
+func writeAudit(ctx context.Context, tx TxRunner, table string, cfg AuditConfig, before, after []map[string]any) error {
+	inserts, err := auditInserts(ctx, table, cfg, before, after)
+	if err != nil {
+		return err
+	}
+	for _, q := range inserts {
+		if _, err = q.RunWith(tx).ExecContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditInsertParams is the number of values bound per change
+const auditInsertParams = 6
+
+// auditInserts are the statements recording the changes between before and after,
+// split so none binds more than PostgresPlaceholderLimit values
+func auditInserts(ctx context.Context, table string, cfg AuditConfig, before, after []map[string]any) (ret []sq.InsertBuilder, err error) {
+	changes, err := auditChanges(cfg, before, after)
+	if err != nil {
+		return
+	}
+	actor := auditActor(ctx)
+	for batch := range slices.Chunk(changes, PostgresPlaceholderLimit/auditInsertParams) {
+		q := PostgresDialect.Builder().Insert(AuditTable).Columns("table_name", "pk", "op", "before", "after", "actor")
+		for _, c := range batch {
+			b, err := auditJSON(c.before)
+			if err != nil {
+				return nil, err
+			}
+			a, err := auditJSON(c.after)
+			if err != nil {
+				return nil, err
+			}
+			q = q.Values(table, c.pk, string(c.op), b, a, actor)
+		}
+		ret = append(ret, q)
+	}
+	return
+}
+
+// auditJSON renders a row as text, which binds to jsonb with every driver
+func auditJSON(row map[string]any) (any, error) {
+	if row == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(row)
+	return string(data), err
+}
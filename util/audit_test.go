@@ -0,0 +1,214 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"testing"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditChanges(t *testing.T) {
+	cfg := AuditConfig{Ignore: []string{"updated_at"}}
+	cfg.SetDefault()
+	before := []map[string]any{
+		{"id": json.Number("1"), "name": "a", "updated_at": "t0"},
+		{"id": json.Number("2"), "name": "b", "updated_at": "t0"},
+		{"id": json.Number("3"), "name": "c", "updated_at": "t0"},
+	}
+	after := []map[string]any{
+		{"id": json.Number("1"), "name": "aa", "updated_at": "t1"},
+		// only an ignored column changed
+		{"id": json.Number("2"), "name": "b", "updated_at": "t1"},
+		{"id": json.Number("4"), "name": "d", "updated_at": "t1"},
+	}
+	changes, err := auditChanges(cfg, before, after)
+	assert.Nil(t, err)
+	assert.Equal(t, []auditChange{
+		{pk: `{"id":1}`, op: AuditUpdate, before: map[string]any{"name": "a"}, after: map[string]any{"name": "aa"}},
+		{pk: `{"id":3}`, op: AuditDelete, before: before[2]},
+		{pk: `{"id":4}`, op: AuditInsert, after: after[2]},
+	}, changes)
+}
+
+func TestAuditPKIn(t *testing.T) {
+	rows := []map[string]any{{"id": json.Number("1"), "k": "x"}, {"id": json.Number("2.5"), "k": "y"}}
+
+	batches := AuditConfig{PKs: []string{"id"}}.pkIn(rows)
+	assert.Len(t, batches, 1)
+	query, args, err := batches[0].ToSql()
+	assert.Nil(t, err)
+	assert.Equal(t, "id IN (?,?)", query)
+	assert.Equal(t, []any{int64(1), 2.5}, args)
+
+	batches = AuditConfig{PKs: []string{"id", "k"}}.pkIn(rows)
+	assert.Len(t, batches, 1)
+	query, args, err = batches[0].ToSql()
+	assert.Nil(t, err)
+	assert.Equal(t, "(id = ? AND k = ? OR id = ? AND k = ?)", query)
+	assert.Equal(t, []any{int64(1), "x", 2.5, "y"}, args)
+
+	assert.Empty(t, AuditConfig{PKs: []string{"id"}}.pkIn(nil))
+
+	// no statement binds more than the placeholder limit
+	many := make([]map[string]any, 40000)
+	for i := range many {
+		many[i] = map[string]any{"id": i, "k": "x"}
+	}
+	for pks, want := range map[int]int{1: 1, 2: 2} {
+		batches = AuditConfig{PKs: []string{"id", "k"}[:pks]}.pkIn(many)
+		assert.Len(t, batches, want)
+		for _, b := range batches {
+			_, args, _ := b.ToSql()
+			assert.LessOrEqual(t, len(args), PostgresPlaceholderLimit)
+		}
+	}
+}
+
+func TestAuditInsertsBatches(t *testing.T) {
+	after := make([]map[string]any, 12000)
+	for i := range after {
+		after[i] = map[string]any{"id": i}
+	}
+	inserts, err := auditInserts(context.Background(), "t", AuditConfig{PKs: []string{"id"}}, nil, after)
+	assert.Nil(t, err)
+	assert.Len(t, inserts, 2)
+	total := 0
+	for _, q := range inserts {
+		_, args, err := q.ToSql()
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, len(args), PostgresPlaceholderLimit)
+		total += len(args)
+	}
+	assert.Equal(t, 12000*auditInsertParams, total)
+}
+
+func TestAuditActor(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", auditActor(ctx))
+	assert.Equal(t, "a@b.c", auditActor(WithUser(ctx, UserPayload{Username: "a", Email: "a@b.c"})))
+	assert.Equal(t, "a", auditActor(WithUser(ctx, UserPayload{Username: "a"})))
+}
+
+func TestAuditMigrations(t *testing.T) {
+	files, err := fs.Glob(AuditMigrations, "*.sql")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1_audit_log.down.sql", "1_audit_log.up.sql"}, files)
+
+	src, err := MigrationFS(AuditMigrations, ".")
+	assert.Nil(t, err)
+	v, err := src.First()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, v)
+
+	// CreateAuditTable runs the up migration on every start
+	up, err := fs.ReadFile(AuditMigrations, "1_audit_log.up.sql")
+	assert.Nil(t, err)
+	assert.NotContains(t, string(up), "DROP")
+}
+
+func TestCreateAuditTableTwice(t *testing.T) {
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	ctx := context.Background()
+	assert.Nil(t, CreateAuditTable(ctx, db))
+	_, err := db.Exec("INSERT INTO audit_log (table_name, pk, op) VALUES ('t', '{\"id\": 1}', 'insert')")
+	assert.Nil(t, err)
+
+	assert.Nil(t, CreateAuditTable(ctx, db))
+	history, err := AuditHistoryCtx(ctx, LOG, db, "t", map[string]any{"id": 1})
+	assert.Nil(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestAudit(t *testing.T) {
+	type row struct {
+		ID   int    `db:"id"`
+		Name string `db:"name"`
+	}
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	ctx := WithUser(context.Background(), UserPayload{Email: "admin@x.com"})
+	assert.Nil(t, CreateAuditTable(ctx, db))
+	_, err := db.Exec("CREATE TABLE audited (id serial primary key, name text)")
+	assert.Nil(t, err)
+	registerTestTable(t, RegisterAudit, audits, "audited", AuditConfig{})
+
+	id, err := CreateSkipCtx(ctx, LOG, db, "audited", row{Name: "a"}, []string{"id"}, []string{"id"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, id)
+	assert.Nil(t, UpdateWithIDCtx(ctx, LOG, db, "audited", id, map[string]any{"name": "b"}))
+	assert.Nil(t, UpsertManyCtx(ctx, LOG, db, "audited", []string{"id"}, "db", []row{{ID: 1, Name: "c"}, {ID: 5, Name: "e"}}, nil, nil))
+
+	// a failing write leaves no trace
+	assert.NotNil(t, UpdateMCtx(ctx, LOG, db, "audited", map[string]any{"id": 1}, map[string]any{"missing": 1}))
+
+	assert.Nil(t, DeleteCtx(ctx, LOG, db, "audited", []string{"id = 1"}))
+
+	history, err := AuditHistoryCtx(ctx, LOG, db, "audited", map[string]any{"id": 1})
+	assert.Nil(t, err)
+	assert.Equal(t, []AuditOp{AuditInsert, AuditUpdate, AuditUpdate, AuditDelete}, Map(history, func(e AuditEntry) AuditOp { return e.Op }))
+	assert.JSONEq(t, `{"id": 1, "name": "a"}`, string(history[0].After))
+	assert.JSONEq(t, `{"name": "a"}`, string(history[1].Before))
+	assert.JSONEq(t, `{"name": "b"}`, string(history[1].After))
+	assert.JSONEq(t, `{"name": "c"}`, string(history[2].After))
+	assert.Nil(t, history[3].After)
+	assert.Equal(t, "admin@x.com", history[0].Actor)
+
+	history, err = AuditHistoryCtx(ctx, LOG, db, "audited", map[string]any{"id": 5})
+	assert.Nil(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, AuditInsert, history[0].Op)
+
+	var cnt int
+	assert.Nil(t, sq.Select("count(*)").From(AuditTable).RunWith(db).QueryRow().Scan(&cnt))
+	assert.Equal(t, 5, cnt)
+}
+
+func TestAuditOtherWrites(t *testing.T) {
+	type row struct {
+		ID        int    `db:"id"`
+		Name      string `db:"name"`
+		IsDeleted bool   `db:"is_deleted"`
+	}
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	ctx := context.Background()
+	assert.Nil(t, CreateAuditTable(ctx, db))
+	_, err := db.Exec(`CREATE TABLE audited_repo (id serial primary key, name text, is_deleted bool not null default false);
+		CREATE TABLE audited_sd (id serial primary key, name text, is_deleted bool not null default false)`)
+	assert.Nil(t, err)
+	registerTestTable(t, RegisterAudit, audits, "audited_repo", AuditConfig{})
+	registerTestTable(t, RegisterAudit, audits, "audited_sd", AuditConfig{})
+	registerTestTable(t, RegisterSoftDelete, softDeletes, "audited_sd", SoftDeleteConfig{})
+	ops := func(table string, id int) []AuditOp {
+		history, err := AuditHistoryCtx(ctx, LOG, db, table, map[string]any{"id": id})
+		assert.Nil(t, err)
+		return Map(history, func(e AuditEntry) AuditOp { return e.Op })
+	}
+
+	repo, err := NewRepository[row](LOG, db, RepositoryConfig{Table: "audited_repo", PKs: []string{"id"}, InsertSkip: []string{"id"}})
+	assert.Nil(t, err)
+	created, err := repo.Create(ctx, row{Name: "a"})
+	assert.Nil(t, err)
+	assert.Equal(t, row{ID: 1, Name: "a"}, created)
+	assert.Nil(t, repo.Delete(ctx, 1))
+	assert.Equal(t, []AuditOp{AuditInsert, AuditDelete}, ops("audited_repo", 1))
+
+	_, err = CreateCtx(ctx, LOG, db, "audited_sd", row{Name: "a"}, []string{"id"}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, SoftDeleteCtx(ctx, LOG, db, "audited_sd", map[string]any{"id": 1}))
+	assert.Nil(t, RestoreCtx(ctx, LOG, db, "audited_sd", map[string]any{"id": 1}))
+	assert.Nil(t, SoftDeleteCtx(ctx, LOG, db, "audited_sd", map[string]any{"id": 1}))
+	n, err := PurgeCtx(ctx, LOG, db, "audited_sd", map[string]any{"id": 1})
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, n)
+	assert.Equal(t, []AuditOp{AuditInsert, AuditUpdate, AuditUpdate, AuditUpdate, AuditDelete}, ops("audited_sd", 1))
+
+	ret, err := CopyUpsert(ctx, LOG, db, "audited_repo", []string{"id"}, []row{{ID: 2, Name: "b"}, {ID: 3, Name: "c"}}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, UpsertResult{Inserted: 2}, ret)
+	_, err = CopyUpsert(ctx, LOG, db, "audited_repo", []string{"id"}, []row{{ID: 2, Name: "bb"}}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []AuditOp{AuditInsert, AuditUpdate}, ops("audited_repo", 2))
+	assert.Equal(t, []AuditOp{AuditInsert}, ops("audited_repo", 3))
+}
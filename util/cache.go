@@ -0,0 +1,160 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
+)
+
+// NewRedisClients connects to the master and to the slave of cfg, the master doubles
+// as replica when no slave is configured
+func NewRedisClients(cfg RedisConfig) (master, replica *redis.Client) {
+	port := cfg.Port
+	if port == 0 {
+		port = 6379
+	}
+	master = redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%d", cfg.Master, port),
+		Password: cfg.Password,
+	})
+	if cfg.Slave == "" {
+		return master, master
+	}
+	replica = redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%d", cfg.Slave, port),
+		Password: cfg.Password,
+	})
+	return
+}
+
+type CacheConfig struct {
+	// Prefix namespaces the keys, e.g. the service and the type cached
+	Prefix string
+	// TTL is the expiry of Set and GetOrLoad, 0 keeps the keys forever
+	TTL time.Duration
+	// LoadTimeout bounds a load of GetOrLoad, which outlives the cancellation of the caller starting it, default 30s
+	LoadTimeout time.Duration
+}
+
+func (c *CacheConfig) SetDefault() {
+	if c.LoadTimeout == 0 {
+		c.LoadTimeout = 30 * time.Second
+	}
+}
+
+// Cache stores T as JSON in redis, reads go to the replica and writes to the master
+type Cache[T any] struct {
+	log     zerolog.Logger
+	master  redis.Cmdable
+	replica redis.Cmdable
+	cfg     CacheConfig
+	group   singleflight.Group
+}
+
+func NewCache[T any](log zerolog.Logger, master, replica redis.Cmdable, cfg CacheConfig) *Cache[T] {
+	if replica == nil {
+		replica = master
+	}
+	cfg.SetDefault()
+	return &Cache[T]{
+		log:     log,
+		master:  master,
+		replica: replica,
+		cfg:     cfg,
+	}
+}
+
+func (c *Cache[T]) key(key string) string {
+	if c.cfg.Prefix == "" {
+		return key
+	}
+	return c.cfg.Prefix + ":" + key
+}
+
+// Get returns ok false on a miss
+func (c *Cache[T]) Get(ctx context.Context, key string) (ret T, ok bool, err error) {
+	data, err := c.replica.Get(ctx, c.key(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return ret, false, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &ret); err != nil {
+		return
+	}
+	return ret, true, nil
+}
+
+func (c *Cache[T]) Set(ctx context.Context, key string, v T) error {
+	return c.SetTTL(ctx, key, v, c.cfg.TTL)
+}
+
+func (c *Cache[T]) SetTTL(ctx context.Context, key string, v T, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.master.Set(ctx, c.key(key), data, ttl).Err()
+}
+
+func (c *Cache[T]) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.master.Del(ctx, Map(keys, c.key)...).Err()
+}
+
+// GetOrLoad returns the cached value or calls load and caches its result, concurrent misses of
+// one key share a single load. Redis failures are logged and fall through to load, errors of
+// load are returned and never cached. The load is detached from the cancellation of ctx and
+// bounded by LoadTimeout instead, a caller giving up does not fail the others waiting on it.
+func (c *Cache[T]) GetOrLoad(ctx context.Context, key string, load func(ctx context.Context) (T, error)) (ret T, err error) {
+	ret, ok, err := c.Get(ctx, key)
+	if err != nil {
+		c.log.Err(err).Str("key", key).Msg("error get cache")
+	}
+	if ok {
+		return ret, nil
+	}
+
+	done := c.group.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.cfg.LoadTimeout)
+		defer cancel()
+		loaded, err := load(ctx)
+		if err != nil {
+			return loaded, err
+		}
+		if e := c.Set(ctx, key, loaded); e != nil {
+			c.log.Err(e).Str("key", key).Msg("error set cache")
+		}
+		return loaded, nil
+	})
+	select {
+	case <-ctx.Done():
+		return ret, ctx.Err()
+	case res := <-done:
+		ret, _ = res.Val.(T)
+		return ret, res.Err
+	}
+}
+
+// CacheKeyM is the key of a GetM lookup, map keys are marshalled in order so equal lookups share it
+func CacheKeyM(table string, where map[string]any) string {
+	data, _ := json.Marshal(where)
+	return table + ":" + string(data)
+}
+
+// GetMCached is GetMCtx behind cache, the entries have to be deleted by whoever updates the rows
+func GetMCached[T any](ctx context.Context, log zerolog.Logger, cache *Cache[T], con sqlx.QueryerContext, table string, where map[string]any) (T, error) {
+	return cache.GetOrLoad(ctx, CacheKeyM(table, where), func(ctx context.Context) (T, error) {
+		return GetMCtx[T](ctx, log, con, table, where)
+	})
+}
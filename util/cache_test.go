@@ -0,0 +1,146 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type cacheItem struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func newTestCache[T any](t *testing.T, cfg CacheConfig) (*Cache[T], *miniredis.Miniredis) {
+	s := miniredis.RunT(t)
+	port, _ := strconv.Atoi(s.Port())
+	master, replica := NewRedisClients(RedisConfig{Master: s.Host(), Port: port})
+	assert.Same(t, master, replica)
+	t.Cleanup(func() { _ = master.Close() })
+	return NewCache[T](LOG, master, replica, cfg), s
+}
+
+func TestCache(t *testing.T) {
+	c, s := newTestCache[cacheItem](t, CacheConfig{Prefix: "item", TTL: time.Minute})
+	ctx := context.Background()
+
+	_, ok, err := c.Get(ctx, "1")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, c.Set(ctx, "1", cacheItem{ID: 1, Name: "a"}))
+	assert.True(t, s.Exists("item:1"))
+	assert.Equal(t, time.Minute, s.TTL("item:1"))
+
+	got, ok, err := c.Get(ctx, "1")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, cacheItem{ID: 1, Name: "a"}, got)
+
+	s.FastForward(2 * time.Minute)
+	_, ok, _ = c.Get(ctx, "1")
+	assert.False(t, ok)
+
+	assert.Nil(t, c.SetTTL(ctx, "2", cacheItem{ID: 2}, 0))
+	assert.Equal(t, time.Duration(0), s.TTL("item:2"))
+	assert.Nil(t, c.Delete(ctx, "2", "3"))
+	assert.False(t, s.Exists("item:2"))
+	assert.Nil(t, c.Delete(ctx))
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	c, s := newTestCache[cacheItem](t, CacheConfig{})
+	ctx := context.Background()
+
+	var loads atomic.Int32
+	release := make(chan struct{})
+	load := func(ctx context.Context) (cacheItem, error) {
+		loads.Add(1)
+		<-release
+		return cacheItem{ID: 7}, nil
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			got, err := c.GetOrLoad(ctx, "7", load)
+			assert.Nil(t, err)
+			assert.Equal(t, 7, got.ID)
+		})
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), loads.Load())
+	assert.True(t, s.Exists("7"))
+
+	// cached now
+	_, err := c.GetOrLoad(ctx, "7", load)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), loads.Load())
+
+	// errors are not cached
+	boom := errors.New("boom")
+	_, err = c.GetOrLoad(ctx, "8", func(ctx context.Context) (cacheItem, error) { return cacheItem{}, boom })
+	assert.ErrorIs(t, err, boom)
+	assert.False(t, s.Exists("8"))
+
+	// redis being down falls through to load
+	s.Close()
+	got, err := c.GetOrLoad(ctx, "9", func(ctx context.Context) (cacheItem, error) { return cacheItem{ID: 9}, nil })
+	assert.Nil(t, err)
+	assert.Equal(t, 9, got.ID)
+}
+
+func TestCacheGetOrLoadCancel(t *testing.T) {
+	c, s := newTestCache[cacheItem](t, CacheConfig{LoadTimeout: time.Second})
+	started, release := make(chan struct{}), make(chan struct{})
+	load := func(ctx context.Context) (cacheItem, error) {
+		close(started)
+		select {
+		case <-release:
+			return cacheItem{ID: 1}, nil
+		case <-ctx.Done():
+			return cacheItem{}, ctx.Err()
+		}
+	}
+
+	// the first caller gives up, the one waiting on the same load still gets it
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := c.GetOrLoad(first, "1", load)
+		firstErr <- err
+	}()
+	<-started
+	second := make(chan cacheItem)
+	go func() {
+		got, err := c.GetOrLoad(context.Background(), "1", load)
+		assert.Nil(t, err)
+		second <- got
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-firstErr, context.Canceled)
+	close(release)
+	assert.Equal(t, 1, (<-second).ID)
+	assert.True(t, s.Exists("1"))
+
+	// a stuck load is bounded
+	_, err := c.GetOrLoad(context.Background(), "2", func(ctx context.Context) (cacheItem, error) {
+		<-ctx.Done()
+		return cacheItem{}, ctx.Err()
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestCacheKeyM(t *testing.T) {
+	assert.Equal(t, `user:{"a":1,"b":"x"}`, CacheKeyM("user", map[string]any{"b": "x", "a": 1}))
+}
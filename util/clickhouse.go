@@ -0,0 +1,149 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/rs/zerolog"
+	"github.com/shopspring/decimal"
+)
+
+// NewClickhouseConn opens a native clickhouse connection from the same url NewDB takes
+func NewClickhouseConn(url string) (driver.Conn, error) {
+	opts, err := clickhouse.ParseDSN(url)
+	if err != nil {
+		return nil, err
+	}
+	return clickhouse.Open(opts)
+}
+
+type ClickhouseInsertConfig struct {
+	// BatchSize is the number of rows sent per batch
+	BatchSize int
+	// AsyncInsert lets the server buffer the inserts, see async_insert in the clickhouse docs
+	AsyncInsert bool
+	// WaitAsyncInsert only returns once the buffered rows are flushed
+	WaitAsyncInsert bool
+}
+
+func (c *ClickhouseInsertConfig) SetDefault() {
+	if c.BatchSize <= 0 {
+		c.BatchSize = 10000
+	}
+}
+
+// ClickhouseInserter writes []T through PrepareBatch/Append, the columns are the db tags of T.
+// Slices map to Array, maps to Map, pointers to Nullable and time.Time to DateTime/DateTime64.
+type ClickhouseInserter[T any] struct {
+	log   zerolog.Logger
+	conn  driver.Conn
+	table string
+	cols  []string
+	cfg   ClickhouseInsertConfig
+}
+
+func NewClickhouseInserter[T any](log zerolog.Logger, conn driver.Conn, table string, cfg ClickhouseInsertConfig) ClickhouseInserter[T] {
+	cfg.SetDefault()
+	return ClickhouseInserter[T]{
+		log:   log,
+		conn:  conn,
+		table: table,
+		cols:  StructTags(*new(T), "db", nil),
+		cfg:   cfg,
+	}
+}
+
+func (c ClickhouseInserter[T]) query() string {
+	d := ClickhouseDialect
+	return fmt.Sprintf("INSERT INTO %s (%s)", d.Ident(c.table), strings.Join(d.Idents(c.cols), ","))
+}
+
+func (c ClickhouseInserter[T]) settings() clickhouse.Settings {
+	if !c.cfg.AsyncInsert {
+		return nil
+	}
+	wait := 0
+	if c.cfg.WaitAsyncInsert {
+		wait = 1
+	}
+	return clickhouse.Settings{
+		"async_insert":          1,
+		"wait_for_async_insert": wait,
+	}
+}
+
+// Insert sends rows in batches of BatchSize and returns the number of rows sent
+func (c ClickhouseInserter[T]) Insert(ctx context.Context, rows []T) (sent int, err error) {
+	if settings := c.settings(); settings != nil {
+		ctx = clickhouse.Context(ctx, clickhouse.WithSettings(settings))
+	}
+
+	for chunk := range slices.Chunk(rows, c.cfg.BatchSize) {
+		if err = c.send(ctx, chunk); err != nil {
+			c.log.Err(err).Str("table", c.table).Int("sent", sent).Msg("error clickhouse batch insert")
+			return
+		}
+		sent += len(chunk)
+	}
+	return
+}
+
+func (c ClickhouseInserter[T]) send(ctx context.Context, rows []T) (err error) {
+	batch, err := c.conn.PrepareBatch(ctx, c.query())
+	if err != nil {
+		return
+	}
+	defer func() {
+		if !batch.IsSent() {
+			_ = batch.Abort()
+		}
+	}()
+
+	for _, row := range rows {
+		_, vals := ExtractTags(row, "db", nil)
+		for i := range vals {
+			vals[i] = clickhouseValue(vals[i])
+		}
+		if err = batch.Append(vals...); err != nil {
+			return
+		}
+	}
+	return batch.Send()
+}
+
+// clickhouseValue converts the types of this package and named slices/maps into what the driver appends
+func clickhouseValue(v any) any {
+	switch val := v.(type) {
+	case Decimal:
+		return val.Unwrap()
+	case *Decimal:
+		if val == nil {
+			return (*decimal.Decimal)(nil)
+		}
+		d := val.Unwrap()
+		return &d
+	}
+
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return v
+	}
+	t := rv.Type()
+	if t.Name() == "" {
+		return v
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return rv.Convert(reflect.MapOf(t.Key(), t.Elem())).Interface()
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.Uint8 {
+			return rv.Convert(reflect.SliceOf(t.Elem())).Interface()
+		}
+	}
+	return v
+}
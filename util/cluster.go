@@ -0,0 +1,281 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+)
+
+type ReplicaBalance string
+
+const (
+	BalanceRoundRobin ReplicaBalance = "round_robin"
+	BalanceLeastConn  ReplicaBalance = "least_conn"
+)
+
+type ReplicaConfig struct {
+	URL  string   `yaml:"url"`
+	Pool DBConfig `yaml:"pool"`
+}
+
+type DBClusterConfig struct {
+	Primary  ReplicaConfig   `yaml:"primary"`
+	Replicas []ReplicaConfig `yaml:"replicas"`
+	Balance  ReplicaBalance  `yaml:"balance"`
+	// HealthInterval is how often the replicas are pinged
+	HealthInterval time.Duration `yaml:"health_interval"`
+	// EjectAfter consecutive failed pings take a replica out of rotation until a ping succeeds again
+	EjectAfter int `yaml:"eject_after"`
+}
+
+func (c *DBClusterConfig) SetDefault() {
+	if c.Balance == "" {
+		c.Balance = BalanceRoundRobin
+	}
+	if c.HealthInterval <= 0 {
+		c.HealthInterval = 5 * time.Second
+	}
+	if c.EjectAfter <= 0 {
+		c.EjectAfter = 3
+	}
+}
+
+type replica struct {
+	db       *sqlx.DB
+	failures atomic.Int32
+}
+
+// DBCluster sends writes to the primary and spreads reads over the healthy replicas,
+// falling back to the primary when none is left. It is a runner itself and can be passed to
+// every helper: plain SELECTs go to Reader, anything else and transactions go to Primary.
+type DBCluster struct {
+	primary   *sqlx.DB
+	replicas  []*replica
+	cfg       DBClusterConfig
+	next      atomic.Uint64
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// OpenDBCluster connects to every node with OpenDB and starts the replica health checks
+func OpenDBCluster(ctx context.Context, cfg DBClusterConfig, policy RetryPolicy) (ret *DBCluster, err error) {
+	primary, err := OpenDB(ctx, cfg.Primary.URL, cfg.Primary.Pool, policy)
+	if err != nil {
+		return
+	}
+	replicas := make([]*sqlx.DB, 0, len(cfg.Replicas))
+	for _, r := range cfg.Replicas {
+		db, err := OpenDB(ctx, r.URL, r.Pool, policy)
+		if err != nil {
+			_ = primary.Close()
+			for _, opened := range replicas {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		replicas = append(replicas, db)
+	}
+	return NewDBCluster(primary, replicas, cfg), nil
+}
+
+// NewDBCluster takes ownership of already opened connections and starts the replica health checks
+func NewDBCluster(primary *sqlx.DB, replicas []*sqlx.DB, cfg DBClusterConfig) *DBCluster {
+	cfg.SetDefault()
+	c := &DBCluster{
+		primary: primary,
+		cfg:     cfg,
+		stop:    make(chan struct{}),
+	}
+	for _, db := range replicas {
+		c.replicas = append(c.replicas, &replica{db: db})
+	}
+
+	if len(c.replicas) > 0 {
+		c.wg.Add(1)
+		go c.healthLoop()
+	}
+	return c
+}
+
+func (c *DBCluster) Primary() *sqlx.DB {
+	return c.primary
+}
+
+type readPrimaryKey struct{}
+
+// ReadPrimary marks ctx so Reader returns the primary, for reads that must see a write just made
+func ReadPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readPrimaryKey{}, true)
+}
+
+// Reader picks a healthy replica by the configured balance, or the primary when ctx is marked
+// by ReadPrimary or every replica is ejected
+func (c *DBCluster) Reader(ctx context.Context) *sqlx.DB {
+	if primary, _ := ctx.Value(readPrimaryKey{}).(bool); primary {
+		return c.primary
+	}
+
+	healthy := make([]*replica, 0, len(c.replicas))
+	for _, r := range c.replicas {
+		if r.healthy(c.cfg.EjectAfter) {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return c.primary
+	}
+
+	if c.cfg.Balance == BalanceLeastConn {
+		best := healthy[0]
+		for _, r := range healthy[1:] {
+			if r.db.Stats().InUse < best.db.Stats().InUse {
+				best = r
+			}
+		}
+		return best.db
+	}
+	return healthy[(c.next.Add(1)-1)%uint64(len(healthy))].db
+}
+
+// Healthy returns the number of replicas in rotation
+func (c *DBCluster) Healthy() (cnt int) {
+	for _, r := range c.replicas {
+		if r.healthy(c.cfg.EjectAfter) {
+			cnt++
+		}
+	}
+	return
+}
+
+// Close stops the health checks and closes every connection, closing again is a no-op
+func (c *DBCluster) Close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		c.wg.Wait()
+
+		errs := []error{c.primary.Close()}
+		for _, r := range c.replicas {
+			errs = append(errs, r.db.Close())
+		}
+		err = errors.Join(errs...)
+	})
+	return
+}
+
+var (
+	writeKeywordRe = regexp.MustCompile(`(?i)\b(INSERT|UPDATE|DELETE|MERGE|TRUNCATE|FOR\s+(NO\s+KEY\s+UPDATE|KEY\s+SHARE|SHARE))\b`)
+	readQueryRe    = regexp.MustCompile(`(?i)^[\s(]*(SELECT|WITH|VALUES|SHOW|EXPLAIN)\b`)
+)
+
+// isReadQuery is true for statements a replica can answer: no write, not even in a CTE, and no row lock.
+// Reads with side effects, e.g. calling nextval, have to be sent with ReadPrimary.
+func isReadQuery(query string) bool {
+	return readQueryRe.MatchString(query) && !writeKeywordRe.MatchString(query)
+}
+
+func (c *DBCluster) route(ctx context.Context, query string) *sqlx.DB {
+	if isReadQuery(query) {
+		return c.Reader(ctx)
+	}
+	return c.primary
+}
+
+// Unwrap is the primary, WithTx starts its transactions there
+func (c *DBCluster) Unwrap() sq.BaseRunner {
+	return c.primary
+}
+
+func (c *DBCluster) DriverName() string {
+	return c.primary.DriverName()
+}
+
+func (c *DBCluster) Rebind(query string) string {
+	return c.primary.Rebind(query)
+}
+
+func (c *DBCluster) BindNamed(query string, arg any) (string, []any, error) {
+	return c.primary.BindNamed(query, arg)
+}
+
+func (c *DBCluster) Exec(query string, args ...any) (sql.Result, error) {
+	return c.primary.Exec(query, args...)
+}
+
+func (c *DBCluster) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return c.primary.ExecContext(ctx, query, args...)
+}
+
+func (c *DBCluster) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.QueryContext(context.Background(), query, args...)
+}
+
+func (c *DBCluster) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return c.route(ctx, query).QueryContext(ctx, query, args...)
+}
+
+func (c *DBCluster) Queryx(query string, args ...any) (*sqlx.Rows, error) {
+	return c.QueryxContext(context.Background(), query, args...)
+}
+
+func (c *DBCluster) QueryxContext(ctx context.Context, query string, args ...any) (*sqlx.Rows, error) {
+	return c.route(ctx, query).QueryxContext(ctx, query, args...)
+}
+
+func (c *DBCluster) QueryRow(query string, args ...any) *sql.Row {
+	return c.QueryRowContext(context.Background(), query, args...)
+}
+
+func (c *DBCluster) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return c.route(ctx, query).QueryRowContext(ctx, query, args...)
+}
+
+func (c *DBCluster) QueryRowx(query string, args ...any) *sqlx.Row {
+	return c.QueryRowxContext(context.Background(), query, args...)
+}
+
+func (c *DBCluster) QueryRowxContext(ctx context.Context, query string, args ...any) *sqlx.Row {
+	return c.route(ctx, query).QueryRowxContext(ctx, query, args...)
+}
+
+func (r *replica) healthy(ejectAfter int) bool {
+	return int(r.failures.Load()) < ejectAfter
+}
+
+func (c *DBCluster) healthLoop() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.cfg.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.checkReplicas()
+		}
+	}
+}
+
+func (c *DBCluster) checkReplicas() {
+	for i, r := range c.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), c.cfg.HealthInterval)
+		err := r.db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			if r.failures.Swap(0) >= int32(c.cfg.EjectAfter) {
+				LOG.Info().Int("replica", i).Msg("replica back in rotation")
+			}
+			continue
+		}
+		if r.failures.Add(1) == int32(c.cfg.EjectAfter) {
+			LOG.Warn().Err(err).Int("replica", i).Msg("replica ejected")
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigEnvPrefix starts the environment variables LoadConfig reads
+var ConfigEnvPrefix = "APP"
+
+// configSecretKeys are the key fragments redacted by DumpConfig
+var configSecretKeys = []string{"password", "secret", "token", "credential", "private_key", "api_key"}
+
+const redacted = "******"
+
+// dsnPassword matches the password of key=value DSNs, e.g. `host=db password='p w' dbname=x`
+var dsnPassword = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:\\.|[^'\\])*'|[^\s;&]+)`)
+
+// LoadConfig merges the yaml files in order, later files overriding earlier ones, then applies the
+// environment: a field is addressed by its yaml path joined by double underscores, e.g. APP_POSTGRES__HOST
+// for Postgres.Host, and APP_POSTGRES__PASSWORD_FILE reads the value from a file mounted as secret.
+// SetDefault is called on every struct having it, deepest first, and the result is checked by Validator.
+// The effective config is logged redacted, see DumpConfig.
+func LoadConfig[T any](paths ...string) (ret T, err error) {
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return ret, err
+		}
+		if err = yaml.Unmarshal(data, &ret); err != nil {
+			return ret, fmt.Errorf("error parse %s: %w", path, err)
+		}
+	}
+
+	rv := reflect.ValueOf(&ret).Elem()
+	if err = applyConfigEnv(rv, ConfigEnvPrefix); err != nil {
+		return
+	}
+	applyConfigDefault(rv)
+	if rv.Kind() == reflect.Struct {
+		if err = Validator.Struct(ret); err != nil {
+			return
+		}
+	}
+
+	LOG.Info().Str("config", DumpConfig(ret)).Msg("config loaded")
+	return
+}
+
+// DumpConfig renders cfg as yaml with passwords, secrets, tokens and credentials masked,
+// including the password of urls and of key=value DSNs
+func DumpConfig(cfg any) string {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err.Error()
+	}
+	var tree any
+	if err = yaml.Unmarshal(data, &tree); err != nil {
+		return err.Error()
+	}
+
+	buf := bytes.Buffer{}
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	_ = enc.Encode(redactConfig("", tree))
+	return buf.String()
+}
+
+func redactConfig(key string, v any) any {
+	lower := strings.ToLower(key)
+	for _, secret := range configSecretKeys {
+		if strings.Contains(lower, secret) {
+			if v == nil || v == "" {
+				return v
+			}
+			return redacted
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		for k, vv := range val {
+			val[k] = redactConfig(k, vv)
+		}
+	case []any:
+		for i, vv := range val {
+			val[i] = redactConfig(key, vv)
+		}
+	case string:
+		if u, err := url.Parse(val); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				return strings.Replace(u.Redacted(), ":xxxxx@", ":"+redacted+"@", 1)
+			}
+		}
+		return dsnPassword.ReplaceAllString(val, "${1}"+redacted)
+	}
+	return v
+}
+
+func configFieldName(f reflect.StructField) (name string, inline bool) {
+	tag := f.Tag.Get("yaml")
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+	return name, strings.Contains(opts, "inline")
+}
+
+func applyConfigEnv(rv reflect.Value, env string) error {
+	if rv.Kind() == reflect.Struct && rv.Type() != reflect.TypeFor[time.Time]() {
+		for i := range rv.NumField() {
+			f := rv.Type().Field(i)
+			name, inline := configFieldName(f)
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			fieldEnv := env + "__" + strings.ToUpper(name)
+			if env == ConfigEnvPrefix {
+				fieldEnv = env + "_" + strings.ToUpper(name)
+			}
+			if inline {
+				fieldEnv = env
+			}
+			if err := applyConfigEnv(rv.Field(i), fieldEnv); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	val, ok := os.LookupEnv(env)
+	if file, found := os.LookupEnv(env + "_FILE"); found && !ok {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("error read %s_FILE: %w", env, err)
+		}
+		val, ok = strings.TrimRight(string(data), "\r\n"), true
+	}
+	if !ok {
+		if rv.Kind() == reflect.Pointer && rv.Type().Elem().Kind() == reflect.Struct {
+			if rv.IsNil() {
+				// only keep the struct when the environment sets some of it
+				tmp := reflect.New(rv.Type().Elem())
+				if err := applyConfigEnv(tmp.Elem(), env); err != nil {
+					return err
+				}
+				if !tmp.Elem().IsZero() {
+					rv.Set(tmp)
+				}
+				return nil
+			}
+			return applyConfigEnv(rv.Elem(), env)
+		}
+		return nil
+	}
+	if err := setConfigValue(rv, val); err != nil {
+		return fmt.Errorf("invalid %s: %w", env, err)
+	}
+	return nil
+}
+
+func setConfigValue(rv reflect.Value, val string) (err error) {
+	if rv.Kind() == reflect.Pointer {
+		ptr := reflect.New(rv.Type().Elem())
+		if err = setConfigValue(ptr.Elem(), val); err == nil {
+			rv.Set(ptr)
+		}
+		return
+	}
+
+	var v any
+	switch t := rv.Type(); {
+	case t == reflect.TypeFor[time.Duration]():
+		v, err = cast.ToDurationE(val)
+	case t == reflect.TypeFor[time.Time]():
+		v, err = cast.ToTimeE(val)
+	default:
+		switch t.Kind() {
+		case reflect.String:
+			v = val
+		case reflect.Bool:
+			v, err = cast.ToBoolE(val)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v, err = cast.ToInt64E(val)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v, err = cast.ToUint64E(val)
+		case reflect.Float32, reflect.Float64:
+			v, err = cast.ToFloat64E(val)
+		case reflect.Slice:
+			parts := strings.Split(val, ",")
+			slice := reflect.MakeSlice(t, len(parts), len(parts))
+			for i, p := range parts {
+				if err = setConfigValue(slice.Index(i), strings.TrimSpace(p)); err != nil {
+					return
+				}
+			}
+			rv.Set(slice)
+			return
+		default:
+			return fmt.Errorf("unsupported type %s", t)
+		}
+	}
+	if err != nil {
+		return
+	}
+	rv.Set(reflect.ValueOf(v).Convert(rv.Type()))
+	return
+}
+
+// applyConfigDefault calls SetDefault on the nested structs first, so a parent sees their defaults
+func applyConfigDefault(rv reflect.Value) {
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if !rv.IsNil() {
+			applyConfigDefault(rv.Elem())
+		}
+		return
+	case reflect.Struct:
+		for i := range rv.NumField() {
+			if rv.Type().Field(i).IsExported() {
+				applyConfigDefault(rv.Field(i))
+			}
+		}
+	case reflect.Slice:
+		for i := range rv.Len() {
+			applyConfigDefault(rv.Index(i))
+		}
+	}
+
+	if rv.CanAddr() {
+		if d, ok := rv.Addr().Interface().(interface{ SetDefault() }); ok {
+			d.SetDefault()
+		}
+	}
+}
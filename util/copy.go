@@ -0,0 +1,195 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+)
+
+type UpsertResult struct {
+	Inserted int64 `json:"inserted"`
+	Updated  int64 `json:"updated"`
+}
+
+func (u UpsertResult) Add(another UpsertResult) UpsertResult {
+	return UpsertResult{
+		Inserted: u.Inserted + another.Inserted,
+		Updated:  u.Updated + another.Updated,
+	}
+}
+
+// CopyMany loads rows into table with the COPY protocol, columns are the db tags of T minus skipping.
+// It needs a connection of its own, so it takes the pool and not a transaction.
+func CopyMany[T any](ctx context.Context, log zerolog.Logger, db *sqlx.DB, table string, rows []T, skipping []string) (cnt int64, err error) {
+	if len(rows) == 0 {
+		return
+	}
+	cols, _ := ExtractTags(rows[0], "db", skipping)
+
+	err = withPgxConn(ctx, db, func(conn *pgx.Conn) (e error) {
+		cnt, e = conn.CopyFrom(ctx, copyIdent(table), cols, copySource(rows, skipping))
+		return
+	})
+	if err != nil {
+		log.Err(err).Str("table", table).Int("rows", len(rows)).Msg("error copy many")
+	}
+	return
+}
+
+// CopyUpsert COPYs rows into a temporary staging table and merges it into table with a single
+// INSERT ... SELECT ... ON CONFLICT, following the same UpdateClause semantics as UpsertMany.
+// Rows must be unique on pks, postgres refuses to update the same row twice in one statement.
+// A table registered with RegisterAudit records the merged rows in the same transaction.
+func CopyUpsert[T any](ctx context.Context, log zerolog.Logger, db *sqlx.DB, table string, pks []string, rows []T, mergeStrategy map[string]string) (ret UpsertResult, err error) {
+	if len(rows) == 0 {
+		return
+	}
+	cols, _ := ExtractTags(rows[0], "db", nil)
+	stage := "stage_" + RandomAlphabets(10, true)
+	ident := PostgresDialect.Ident(table)
+	selects := strings.Join(PostgresDialect.Idents(cols), ",")
+	auditCfg, audit := auditOf(ctx, table)
+
+	err = withPgxConn(ctx, db, func(conn *pgx.Conn) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+
+		_, err = tx.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA", stage, selects, ident))
+		if err != nil {
+			return err
+		}
+		if _, err = tx.CopyFrom(ctx, pgx.Identifier{stage}, cols, copySource(rows, nil)); err != nil {
+			return err
+		}
+
+		// the rows about to change, read before the merge when table is audited
+		var before, after []map[string]any
+		returning := "(xmax = 0)"
+		if audit {
+			keys := strings.Join(PostgresDialect.Idents(pks), ",")
+			before, err = copyAuditRows(ctx, tx, fmt.Sprintf("SELECT to_jsonb(%s) FROM %s WHERE (%s) IN (SELECT %s FROM %s) FOR UPDATE",
+				auditRowRef(table), ident, keys, keys, stage))
+			if err != nil {
+				return err
+			}
+			returning += ", to_jsonb(" + auditRowRef(table) + ")"
+		}
+
+		// xmax is only set on rows that existed before, i.e. the updated ones
+		query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (%s) DO UPDATE SET %s RETURNING %s",
+			ident, selects, selects, stage, strings.Join(PostgresDialect.Idents(pks), ","), UpdateClause(cols, pks, mergeStrategy), returning)
+		inserted, err := tx.Query(ctx, query)
+		if err != nil {
+			return err
+		}
+		for inserted.Next() {
+			var isInsert bool
+			var raw []byte
+			dest := []any{&isInsert}
+			if audit {
+				dest = append(dest, &raw)
+			}
+			if err = inserted.Scan(dest...); err != nil {
+				inserted.Close()
+				return err
+			}
+			if isInsert {
+				ret.Inserted++
+			} else {
+				ret.Updated++
+			}
+			if audit {
+				row, err := decodeAuditRow(raw)
+				if err != nil {
+					inserted.Close()
+					return err
+				}
+				after = append(after, row)
+			}
+		}
+		inserted.Close()
+		if err = inserted.Err(); err != nil {
+			return err
+		}
+
+		if audit {
+			inserts, err := auditInserts(ctx, table, auditCfg, before, after)
+			if err != nil {
+				return err
+			}
+			for _, q := range inserts {
+				query, args, _ := q.ToSql()
+				if _, err = tx.Exec(ctx, query, args...); err != nil {
+					log.Err(err).Str("table", table).Msg("error write audit")
+					return err
+				}
+			}
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		ret = UpsertResult{}
+		log.Err(err).Str("table", table).Int("rows", len(rows)).Msg("error copy upsert")
+	}
+	return
+}
+
+func copyAuditRows(ctx context.Context, tx pgx.Tx, query string) (ret []map[string]any, err error) {
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var raw []byte
+		if err = rows.Scan(&raw); err != nil {
+			return
+		}
+		row, err := decodeAuditRow(raw)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, row)
+	}
+	return ret, rows.Err()
+}
+
+func copySource[T any](rows []T, skipping []string) pgx.CopyFromSource {
+	return pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+		_, vals := ExtractTags(rows[i], "db", skipping)
+		return vals, nil
+	})
+}
+
+// copyIdent splits a schema qualified table name
+func copyIdent(table string) pgx.Identifier {
+	return strings.Split(table, ".")
+}
+
+// withPgxConn runs fn on a dedicated pgx connection taken from the pool
+func withPgxConn(ctx context.Context, db *sqlx.DB, fn func(conn *pgx.Conn) error) error {
+	if db.DriverName() != "pgx" {
+		return fmt.Errorf("copy requires the pgx driver, got %s", db.DriverName())
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	return conn.Raw(func(driverConn any) error {
+		c, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		return fn(c.Conn())
+	})
+}
@@ -8,3 +8,15 @@ import (
 func WithTimeout(dur time.Duration) (context.Context, context.CancelFunc) {
 	return context.WithTimeout(context.Background(), dur)
 }
+
+type userKey struct{}
+
+// WithUser carries the authenticated user in ctx, the audit trail records it as actor
+func WithUser(ctx context.Context, user UserPayload) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+func UserFromCtx(ctx context.Context) (UserPayload, bool) {
+	user, ok := ctx.Value(userKey{}).(UserPayload)
+	return user, ok
+}
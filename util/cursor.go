@@ -0,0 +1,296 @@
+package util
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+// CursorSecret signs the cursors handed to clients, it has to be set before any cursor is encoded
+// and shared by all replicas of a service
+var CursorSecret []byte
+
+var ErrCursorSecretNotSet = errors.New("cursor secret not set")
+
+// MaxCursorPerPage bounds the per_page of a cursor page, a larger one is a bad request
+var MaxCursorPerPage = 1000
+
+type SortKey struct {
+	Col  string
+	Desc bool
+}
+
+func (s SortKey) String() string {
+	if s.Desc {
+		return "-" + s.Col
+	}
+	return s.Col
+}
+
+func sortKeysStr(keys []SortKey) string {
+	return strings.Join(Map(keys, SortKey.String), ",")
+}
+
+// Cursor holds the sort key values of the row a page starts after (or before when Backward)
+type Cursor struct {
+	Keys     string            `json:"k"`
+	Values   []json.RawMessage `json:"v"`
+	Backward bool              `json:"b,omitempty"`
+}
+
+func EncodeCursor(c Cursor) (string, error) {
+	if len(CursorSecret) == 0 {
+		return "", ErrCursorSecretNotSet
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signCursor(payload)), nil
+}
+
+func DecodeCursor(s string) (ret Cursor, err error) {
+	if len(CursorSecret) == 0 {
+		return ret, ErrCursorSecretNotSet
+	}
+	payload, sig, ok := strings.Cut(s, ".")
+	if !ok {
+		return ret, ErrBadRequest("malformed cursor")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, signCursor(payload)) {
+		return ret, ErrBadRequest("invalid cursor signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ret, ErrBadRequest("malformed cursor: " + err.Error())
+	}
+	if err = json.Unmarshal(b, &ret); err != nil {
+		return ret, ErrBadRequest("malformed cursor: " + err.Error())
+	}
+	return
+}
+
+func signCursor(payload string) []byte {
+	h := hmac.New(sha256.New, CursorSecret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+type CursorPage struct {
+	Cursor  *Cursor // nil for the first page
+	PerPage int
+}
+
+type CursorResult[T any] struct {
+	Data []T    `json:"data"`
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// GetCursor reads the optional `cursor` and the `per_page` query params
+func GetCursor(ctx echo.Context) (ret CursorPage, err error) {
+	ret.PerPage, err = strconv.Atoi(ctx.QueryParam("per_page"))
+	if err != nil {
+		err = ErrBadRequest("failed to get per_page: " + err.Error())
+		return
+	}
+	if err = checkCursorPerPage(ret.PerPage); err != nil {
+		return
+	}
+
+	if raw := ctx.QueryParam("cursor"); raw != "" {
+		c, e := DecodeCursor(raw)
+		if e != nil {
+			err = e
+			return
+		}
+		ret.Cursor = &c
+	}
+	return
+}
+
+func checkCursorPerPage(perPage int) error {
+	if perPage <= 0 {
+		return ErrBadRequest("per_page must be positive")
+	}
+	if perPage > MaxCursorPerPage {
+		return ErrBadRequest(fmt.Sprintf("per_page must be at most %d", MaxCursorPerPage))
+	}
+	return nil
+}
+
+// keysetWhere builds the predicate selecting rows after vals in the order of keys,
+// `(a, b) > (?, ?)` when all keys share a direction, the expanded OR form otherwise
+func keysetWhere(keys []SortKey, vals []any) sq.Sqlizer {
+	cmp := func(desc bool) string {
+		if desc {
+			return "<"
+		}
+		return ">"
+	}
+
+	sameDirection := !slices.ContainsFunc(keys, func(k SortKey) bool { return k.Desc != keys[0].Desc })
+	if sameDirection {
+		cols := Map(keys, func(k SortKey) string { return k.Col })
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")
+		return sq.Expr(fmt.Sprintf("(%s) %s (%s)", strings.Join(cols, ", "), cmp(keys[0].Desc), placeholders), vals...)
+	}
+
+	var or sq.Or
+	for i, k := range keys {
+		var and sq.And
+		for j := range i {
+			and = append(and, sq.Expr(keys[j].Col+" = ?", vals[j]))
+		}
+		and = append(and, sq.Expr(fmt.Sprintf("%s %s ?", k.Col, cmp(k.Desc)), vals[i]))
+		or = append(or, and)
+	}
+	return or
+}
+
+func orderByKeys(keys []SortKey) []string {
+	return Map(keys, func(k SortKey) string {
+		if k.Desc {
+			return k.Col + " DESC"
+		}
+		return k.Col + " ASC"
+	})
+}
+
+func reverseKeys(keys []SortKey) []SortKey {
+	return Map(keys, func(k SortKey) SortKey { return SortKey{Col: k.Col, Desc: !k.Desc} })
+}
+
+// cursorValues decodes the cursor values into the go types of the matching fields of T
+func cursorValues[T any](c Cursor, keys []SortKey) (ret []any, err error) {
+	if c.Keys != sortKeysStr(keys) {
+		return nil, ErrBadRequest("cursor does not match the sort order")
+	}
+	if len(c.Values) != len(keys) {
+		return nil, ErrBadRequest("cursor does not match the sort keys")
+	}
+
+	tags, zeros := ExtractTags(*new(T), "db", nil)
+	for i, k := range keys {
+		idx := slices.Index(tags, k.Col)
+		v := reflect.New(reflect.TypeOf(zeros[idx]))
+		if err = json.Unmarshal(c.Values[i], v.Interface()); err != nil {
+			return nil, ErrBadRequest(fmt.Sprintf("invalid cursor value for %s: %s", k.Col, err.Error()))
+		}
+		ret = append(ret, v.Elem().Interface())
+	}
+	return
+}
+
+func rowCursor[T any](row T, keys []SortKey, backward bool) (string, error) {
+	tags, vals := ExtractTags(row, "db", nil)
+	c := Cursor{Keys: sortKeysStr(keys), Backward: backward}
+	for _, k := range keys {
+		b, err := json.Marshal(vals[slices.Index(tags, k.Col)])
+		if err != nil {
+			return "", err
+		}
+		c.Values = append(c.Values, b)
+	}
+	return EncodeCursor(c)
+}
+
+func ListCursor[T any](log zerolog.Logger, con sqlx.QueryerContext, page CursorPage, table string, where sq.Sqlizer, keys []SortKey) (ret CursorResult[T], err error) {
+	return ListCursorCtx[T](context.Background(), log, con, page, table, where, keys)
+}
+
+// ListCursorCtx lists a page of rows after (or before) the cursor in the order of keys.
+// The sort keys have to be db tags of T and together identify a row, NULL values are not supported.
+func ListCursorCtx[T any](ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, page CursorPage, table string, where sq.Sqlizer, keys []SortKey) (ret CursorResult[T], err error) {
+	ret.Data = []T{}
+	if len(keys) == 0 {
+		return ret, errors.New("cursor pagination requires at least one sort key")
+	}
+	if err = checkCursorPerPage(page.PerPage); err != nil {
+		return
+	}
+	cols, _ := ExtractTags(*new(T), "db", nil)
+	for _, k := range keys {
+		if !Contains(k.Col, cols) {
+			return ret, ErrBadRequest(fmt.Sprintf("unknown sort key: %s", k.Col))
+		}
+	}
+
+	var backward bool
+	scanKeys := keys
+	d := DialectOf(con)
+	base := d.Builder().Select(d.Idents(cols)...).From(d.Ident(table))
+	if where != nil {
+		base = base.Where(where)
+	}
+	base = whereSoftDelete(base, softDeleteWhere(ctx, table, func(col string) bool {
+		if where == nil {
+			return false
+		}
+		query, _, _ := where.ToSql()
+		return referencesColumn(query, col)
+	}))
+	if page.Cursor != nil {
+		vals, e := cursorValues[T](*page.Cursor, keys)
+		if e != nil {
+			return ret, e
+		}
+		backward = page.Cursor.Backward
+		if backward {
+			scanKeys = reverseKeys(keys)
+		}
+		base = base.Where(keysetWhere(scanKeys, vals))
+	}
+
+	query, args, err := base.
+		OrderBy(orderByKeys(scanKeys)...).
+		Limit(uint64(page.PerPage) + 1).
+		ToSql()
+	if err != nil {
+		return
+	}
+	if err = selectContext(ctx, con, &ret.Data, query, args...); err != nil {
+		log.Err(err).Str("table", table).Str("query", query).Interface("args", args).Msg("error select")
+		return
+	}
+
+	hasMore := len(ret.Data) > page.PerPage
+	if hasMore {
+		ret.Data = ret.Data[:page.PerPage]
+	}
+	if backward {
+		slices.Reverse(ret.Data)
+	}
+	if len(ret.Data) == 0 {
+		return
+	}
+
+	// paging back there is always the page we came from, going forward there is
+	// a previous page unless we started from the first one
+	if hasMore || backward {
+		if ret.Next, err = rowCursor(ret.Data[len(ret.Data)-1], keys, false); err != nil {
+			return
+		}
+	}
+	if (backward && hasMore) || (!backward && page.Cursor != nil) {
+		if ret.Prev, err = rowCursor(ret.Data[0], keys, true); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type cursorRow struct {
+	ID        int       `db:"id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func TestCursorEncoding(t *testing.T) {
+	CursorSecret = []byte("secret")
+	defer func() { CursorSecret = nil }()
+
+	row := cursorRow{ID: 3, CreatedAt: DateUTC(2020, 1, 1)}
+	keys := []SortKey{{Col: "created_at", Desc: true}, {Col: "id"}}
+	encoded, err := rowCursor(row, keys, true)
+	assert.Nil(t, err)
+
+	c, err := DecodeCursor(encoded)
+	assert.Nil(t, err)
+	assert.True(t, c.Backward)
+	assert.Equal(t, "-created_at,id", c.Keys)
+
+	vals, err := cursorValues[cursorRow](c, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, []any{DateUTC(2020, 1, 1), 3}, vals)
+
+	_, err = cursorValues[cursorRow](c, []SortKey{{Col: "id"}})
+	assert.Equal(t, http.StatusBadRequest, err.(Err).Code)
+
+	_, err = DecodeCursor(encoded[:len(encoded)-2])
+	assert.Equal(t, "invalid cursor signature", err.Error())
+
+	CursorSecret = []byte("another")
+	_, err = DecodeCursor(encoded)
+	assert.Equal(t, "invalid cursor signature", err.Error())
+}
+
+func TestKeysetWhere(t *testing.T) {
+	query, args, err := keysetWhere([]SortKey{{Col: "a"}, {Col: "b"}}, []any{1, 2}).ToSql()
+	assert.Nil(t, err)
+	assert.Equal(t, "(a, b) > (?, ?)", query)
+	assert.Equal(t, []any{1, 2}, args)
+
+	query, _, err = keysetWhere([]SortKey{{Col: "a", Desc: true}, {Col: "b", Desc: true}}, []any{1, 2}).ToSql()
+	assert.Nil(t, err)
+	assert.Equal(t, "(a, b) < (?, ?)", query)
+
+	query, args, err = keysetWhere([]SortKey{{Col: "a", Desc: true}, {Col: "b"}}, []any{1, 2}).ToSql()
+	assert.Nil(t, err)
+	assert.Equal(t, "((a < ?) OR (a = ? AND b > ?))", query)
+	assert.Equal(t, []any{1, 1, 2}, args)
+}
+
+func TestGetCursor(t *testing.T) {
+	CursorSecret = []byte("secret")
+	defer func() { CursorSecret = nil }()
+
+	e := echo.New()
+	kit := NewHttpTestKit(e, RequestCfg{QueryParams: StrMap{"per_page": "10"}})
+	page, err := GetCursor(kit.Ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, page.Cursor)
+	assert.Equal(t, 10, page.PerPage)
+
+	kit = NewHttpTestKit(e, RequestCfg{QueryParams: StrMap{"per_page": "10", "cursor": "abc"}})
+	_, err = GetCursor(kit.Ctx)
+	assert.Equal(t, http.StatusBadRequest, err.(Err).Code)
+
+	for _, perPage := range []string{"0", "1001"} {
+		kit = NewHttpTestKit(e, RequestCfg{QueryParams: StrMap{"per_page": perPage}})
+		_, err = GetCursor(kit.Ctx)
+		assert.Equal(t, http.StatusBadRequest, err.(Err).Code, perPage)
+	}
+	kit = NewHttpTestKit(e, RequestCfg{QueryParams: StrMap{"per_page": "1000"}})
+	_, err = GetCursor(kit.Ctx)
+	assert.Nil(t, err)
+}
+
+func TestListCursorPerPage(t *testing.T) {
+	type row struct {
+		ID int `db:"id"`
+	}
+	l, queries := recordQueries(t)
+	keys := []SortKey{{Col: "id"}}
+
+	_, err := ListCursor[row](zerolog.Logger{}, l, CursorPage{PerPage: MaxCursorPerPage + 1}, "t", nil, keys)
+	assert.Equal(t, http.StatusBadRequest, err.(Err).Code)
+	_, err = ListCursor[row](zerolog.Logger{}, l, CursorPage{}, "t", nil, keys)
+	assert.Equal(t, http.StatusBadRequest, err.(Err).Code)
+	assert.Empty(t, queries())
+}
+
+func TestListCursor(t *testing.T) {
+	CursorSecret = []byte("secret")
+	defer func() { CursorSecret = nil }()
+
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	_, err := db.Exec("CREATE TABLE cursor_test (id int, created_at timestamptz)")
+	assert.Nil(t, err)
+	for i := 1; i <= 5; i++ {
+		_, err = db.Exec("INSERT INTO cursor_test VALUES ($1, $2)", i, DateUTC(2020, 1, i%2+1))
+		assert.Nil(t, err)
+	}
+
+	ctx := context.Background()
+	keys := []SortKey{{Col: "created_at", Desc: true}, {Col: "id"}}
+	ids := func(rows []cursorRow) []int { return Map(rows, func(r cursorRow) int { return r.ID }) }
+
+	first, err := ListCursorCtx[cursorRow](ctx, zerolog.Logger{}, db, CursorPage{PerPage: 2}, "cursor_test", nil, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 3}, ids(first.Data))
+	assert.Empty(t, first.Prev)
+
+	next, err := DecodeCursor(first.Next)
+	assert.Nil(t, err)
+	second, err := ListCursorCtx[cursorRow](ctx, zerolog.Logger{}, db, CursorPage{Cursor: &next, PerPage: 2}, "cursor_test", nil, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{5, 2}, ids(second.Data))
+
+	prev, err := DecodeCursor(second.Prev)
+	assert.Nil(t, err)
+	back, err := ListCursorCtx[cursorRow](ctx, zerolog.Logger{}, db, CursorPage{Cursor: &prev, PerPage: 2}, "cursor_test", nil, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 3}, ids(back.Data))
+	assert.Empty(t, back.Prev)
+	assert.NotEmpty(t, back.Next)
+}
@@ -1,137 +1,351 @@
 package util
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
 	"github.com/rs/zerolog"
 )
 
+// The helpers below come in pairs: XxxCtx takes a context as its first argument and
+// runs everything through ExecContext/SelectContext/QueryRowxContext, so request
+// cancellation and deadlines reach the database. Xxx is kept as a thin wrapper
+// running XxxCtx with context.Background().
+//
+// read helpers accept sqlx.QueryerContext (both *sqlx.DB and *sqlx.Tx),
+// write helpers accept squirrel.BaseRunner as before. The SQL follows the
+// Dialect of the connection, see DialectOf. Each XxxCtx runs in a span once
+// EnableTracing is called.
+
 func UpsertMany[T any](log zerolog.Logger, con sq.BaseRunner, table string, pks []string, tag string, toInsert []T, mergeStrategy map[string]string, partitionFunc PartitionFunc) (err error) {
+	return UpsertManyCtx(context.Background(), log, con, table, pks, tag, toInsert, mergeStrategy, partitionFunc.withCtx())
+}
+
+func UpsertManyCtx[T any](ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, pks []string, tag string, toInsert []T, mergeStrategy map[string]string, partitionFunc PartitionFuncCtx) (err error) {
+	_, _, err = upsertMany[T, struct{}](ctx, log, con, table, pks, tag, toInsert, mergeStrategy, partitionFunc, false, nil)
+	return
+}
+
+// UpsertManyResult counts the rows inserted and updated by an upsert, in total and per batch sent
+type UpsertManyResult struct {
+	UpsertResult
+	Batches []UpsertResult `json:"batches"`
+}
+
+func UpsertManyCount[T any](log zerolog.Logger, con sq.BaseRunner, table string, pks []string, tag string, toInsert []T, mergeStrategy map[string]string, partitionFunc PartitionFunc) (UpsertManyResult, error) {
+	return UpsertManyCountCtx(context.Background(), log, con, table, pks, tag, toInsert, mergeStrategy, partitionFunc.withCtx())
+}
+
+// UpsertManyCountCtx is UpsertManyCtx telling the inserted rows from the updated ones
+func UpsertManyCountCtx[T any](ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, pks []string, tag string, toInsert []T, mergeStrategy map[string]string, partitionFunc PartitionFuncCtx) (ret UpsertManyResult, err error) {
+	ret, _, err = upsertMany[T, struct{}](ctx, log, con, table, pks, tag, toInsert, mergeStrategy, partitionFunc, true, nil)
+	return
+}
+
+func UpsertManyReturning[T, R any](log zerolog.Logger, con sq.BaseRunner, table string, pks []string, tag string, toInsert []T, mergeStrategy map[string]string, returning []string, partitionFunc PartitionFunc) ([]R, UpsertManyResult, error) {
+	return UpsertManyReturningCtx[T, R](context.Background(), log, con, table, pks, tag, toInsert, mergeStrategy, returning, partitionFunc.withCtx())
+}
+
+// UpsertManyReturningCtx is UpsertManyCountCtx scanning the returning columns of every row into R,
+// a struct by its db tags or a single value
+func UpsertManyReturningCtx[T, R any](ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, pks []string, tag string, toInsert []T, mergeStrategy map[string]string, returning []string, partitionFunc PartitionFuncCtx) (ret []R, res UpsertManyResult, err error) {
+	res, ret, err = upsertMany[T, R](ctx, log, con, table, pks, tag, toInsert, mergeStrategy, partitionFunc, true, returning)
+	return
+}
+
+// upsertMany sends toInsert in batches of InsertHelper, with count every batch returns whether its rows were inserted
+func upsertMany[T, R any](ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, pks []string, tag string, toInsert []T, mergeStrategy map[string]string, partitionFunc PartitionFuncCtx, count bool, returning []string) (ret UpsertManyResult, out []R, err error) {
+	if cfg, ok := auditOf(ctx, table); ok && len(toInsert) != 0 {
+		// the conflict keys select the rows before and after, whether inserted or updated
+		keys := Map(toInsert, func(t T) map[string]any {
+			cols, vals := ExtractTags(t, tag, nil)
+			key := make(map[string]any, len(pks))
+			for i, col := range cols {
+				if Contains(col, pks) {
+					key[col] = vals[i]
+				}
+			}
+			return key
+		})
+		err = audited(ctx, log, con, table, cfg, AuditConfig{PKs: pks}.pkIn(keys), true, func(ctx context.Context, tx TxRunner) (err error) {
+			// assigned on every attempt, a retried transaction does not count twice
+			ret, out, err = upsertMany[T, R](ctx, log, tx, table, pks, tag, toInsert, mergeStrategy, partitionFunc, count, returning)
+			return
+		})
+		if err != nil {
+			ret, out = UpsertManyResult{}, nil
+		}
+		return
+	}
+	ctx, span := startDBSpan(ctx, con, "UPSERT", table)
+	defer func() { endSpan(span, err) }()
 	if len(toInsert) == 0 {
 		return
 	}
 
-	if partitionFunc != nil {
-		if err = partitionFunc(con, table); err != nil {
+	d := DialectOf(con)
+	cols, _ := ExtractTags(toInsert[0], tag, []string{})
+	merge, err := d.UpsertSuffix(cols, pks, mergeStrategy)
+	if err != nil {
+		log.Err(err).Str("table", table).Msg("error upsert many")
+		return
+	}
+	if count {
+		if err = d.Check(FeatureReturning); err != nil {
 			return
 		}
+		// xmax is only set on rows that existed before, i.e. the updated ones
+		merge += " RETURNING " + strings.Join(append([]string{"(xmax = 0)"}, returning...), ",")
 	}
 
-	cols, _ := ExtractTags(toInsert[0], tag, []string{})
-	merge := fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s",
-		strings.Join(pks, ","),
-		UpdateClause(cols, pks, mergeStrategy))
+	if partitionFunc != nil {
+		if err = partitionFunc(ctx, con, table); err != nil {
+			return
+		}
+	}
 
 	helper := NewInsertHelper(table, cols, merge, con)
+	if count {
+		if len(returning) != 0 {
+			out = make([]R, 0, len(toInsert))
+		}
+		helper.OnBatch(func(rows *sqlx.Rows) error {
+			batch, got, err := scanUpsertBatch[R](rows)
+			if err != nil {
+				return err
+			}
+			ret.Batches = append(ret.Batches, batch)
+			ret.UpsertResult = ret.UpsertResult.Add(batch)
+			out = append(out, got...)
+			return nil
+		})
+	}
 
 	for _, t := range toInsert {
 		_, vals := ExtractTags(t, tag, []string{})
-		if err = helper.Add(vals); err != nil {
+		if err = helper.AddCtx(ctx, vals); err != nil {
 			log.Err(err).Msg("error save")
 			return
 		}
 	}
-	if err = helper.Finish(); err != nil {
+	if err = helper.FinishCtx(ctx); err != nil {
 		log.Err(err).Msg("error finish insert many")
 	}
 	return
 }
 
+var returningMapper = reflectx.NewMapperFunc("db", sqlx.NameMapper)
+
+// scanUpsertBatch counts the rows of a batch by their leading xmax = 0 and scans the other columns into R
+func scanUpsertBatch[R any](rows *sqlx.Rows) (batch UpsertResult, out []R, err error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return
+	}
+	cols = cols[1:]
+	var fields [][]int
+	t := reflect.TypeFor[R]()
+	scalar := t.Kind() != reflect.Struct || reflect.PointerTo(t).Implements(reflect.TypeFor[sql.Scanner]()) ||
+		len(returningMapper.TypeMap(t).Index) == 0
+	switch {
+	case len(cols) == 0:
+	case scalar && len(cols) != 1:
+		return batch, nil, fmt.Errorf("cannot scan %d returning columns into %s", len(cols), t)
+	case !scalar:
+		fields = returningMapper.TraversalsByName(t, cols)
+		for i, f := range fields {
+			if len(f) == 0 {
+				return batch, nil, fmt.Errorf("missing destination name %s in %s", cols[i], t)
+			}
+		}
+	}
+
+	for rows.Next() {
+		var inserted bool
+		var r R
+		dest := []any{&inserted}
+		if scalar && len(cols) == 1 {
+			dest = append(dest, &r)
+		}
+		v := reflect.ValueOf(&r).Elem()
+		for _, f := range fields {
+			dest = append(dest, reflectx.FieldByIndexes(v, f).Addr().Interface())
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return
+		}
+		if inserted {
+			batch.Inserted++
+		} else {
+			batch.Updated++
+		}
+		if len(cols) != 0 {
+			out = append(out, r)
+		}
+	}
+	return
+}
+
 func UpdateS(log zerolog.Logger, con sq.BaseRunner, table string, where []string, sets map[string]any) (err error) {
-	_, err = Psql.Update(table).
+	return UpdateSCtx(context.Background(), log, con, table, where, sets)
+}
+
+func UpdateSCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, where []string, sets map[string]any) (err error) {
+	ctx, span := startDBSpan(ctx, con, "UPDATE", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	if err = d.Check(FeatureUpdate); err != nil {
+		return
+	}
+	q := d.Builder().Update(d.Ident(table)).
 		SetMap(sets).
-		Where(AndWhere(where)).
-		RunWith(con).
-		Exec()
+		Where(AndWhere(where))
+	spanStatement(span, q)
+	_, err = q.RunWith(con).ExecContext(ctx)
 	if err != nil {
 		log.Err(err).Interface("where", where).Str("table", table).Interface("updates", sets).Msg("error update")
 	}
 	return err
 }
 
-func ListS[T any](log zerolog.Logger, con *sqlx.DB, page Page, table string, wheres, order []string) (ret []T, total int, err error) {
+func ListS[T any](log zerolog.Logger, con sqlx.QueryerContext, page Page, table string, wheres, order []string) (ret []T, total int, err error) {
+	return ListSCtx[T](context.Background(), log, con, page, table, wheres, order)
+}
+
+func ListSCtx[T any](ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, page Page, table string, wheres, order []string) (ret []T, total int, err error) {
+	ctx, span := startDBSpan(ctx, con, "SELECT", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
 	ret = []T{}
 	order = append(order, "1")
+	wheres = softDeleteS(ctx, table, wheres)
 
 	col, _ := ExtractTags(*new(T), "db", []string{})
 
-	query, args, _ := Psql.Select(col...).
-		From(table).
+	base := d.Builder().Select(d.Idents(col)...).
+		From(d.Ident(table)).
 		Where(AndWhere(wheres)).
-		Offset(page.Offset()).
-		Limit(page.Limit()).
-		OrderBy(strings.Join(order, ",")).
-		ToSql()
+		OrderBy(strings.Join(order, ","))
+	query, args, _ := d.Paginate(base, page).ToSql()
+	spanStatement(span, sq.Expr(query))
 
-	if err = con.Select(&ret, query, args...); err != nil {
+	if err = selectContext(ctx, con, &ret, query, args...); err != nil {
 		log.Err(err).Str("table", table).Str("query", query).Interface("args", args).Msg("error select")
 		return
 	}
 
-	err = Psql.Select("COUNT(*)").From(table).Where(AndWhere(wheres)).
-		RunWith(con).QueryRow().Scan(&total)
-	if err != nil {
+	query, args, _ = d.Builder().Select("COUNT(*)").From(d.Ident(table)).Where(AndWhere(wheres)).ToSql()
+	if err = con.QueryRowxContext(ctx, query, args...).Scan(&total); err != nil {
 		log.Err(err).Str("table", table).Msg("error count total")
 	}
 	return
 }
 
-func GetS[T any](log zerolog.Logger, con *sqlx.DB, table string, where []string) (ret T, err error) {
-	query, args, _ := Psql.Select("*").
-		From(table).
+func GetS[T any](log zerolog.Logger, con sqlx.QueryerContext, table string, where []string) (ret T, err error) {
+	return GetSCtx[T](context.Background(), log, con, table, where)
+}
+
+func GetSCtx[T any](ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, table string, where []string) (ret T, err error) {
+	ctx, span := startDBSpan(ctx, con, "SELECT", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	where = softDeleteS(ctx, table, where)
+	query, args, _ := d.Builder().Select("*").
+		From(d.Ident(table)).
 		Where(AndWhere(where)).
 		ToSql()
+	spanStatement(span, sq.Expr(query))
 
-	if err = con.QueryRowx(query, args...).StructScan(&ret); err != nil {
-		log.Err(err).Strs("where", where).Str("table", table).Msg("error delete")
+	if err = con.QueryRowxContext(ctx, query, args...).StructScan(&ret); err != nil {
+		log.Err(err).Strs("where", where).Str("table", table).Msg("error get")
 	}
 	return
 }
 
-func GetManyS[T any](log zerolog.Logger, con *sqlx.DB, table string, where []string, orderby []string) (ret []T, err error) {
+func GetManyS[T any](log zerolog.Logger, con sqlx.QueryerContext, table string, where []string, orderby []string) (ret []T, err error) {
+	return GetManySCtx[T](context.Background(), log, con, table, where, orderby)
+}
+
+func GetManySCtx[T any](ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, table string, where []string, orderby []string) (ret []T, err error) {
+	ctx, span := startDBSpan(ctx, con, "SELECT", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	where = softDeleteS(ctx, table, where)
 	ret = []T{}
 	tmp := make([]T, 1)
 	cols, _ := ExtractTags(tmp[0], "db", nil)
-	query, args, _ := Psql.Select(cols...).From(table).
+	query, args, _ := d.Builder().Select(d.Idents(cols)...).From(d.Ident(table)).
 		Where(AndWhere(where)).
 		OrderBy(strings.Join(orderby, ",")).
 		ToSql()
-	if err = con.Select(&ret, query, args...); err != nil {
+	spanStatement(span, sq.Expr(query))
+	if err = selectContext(ctx, con, &ret, query, args...); err != nil {
 		log.Err(err).Type("type", ret).Interface("where", where).Str("table", table).Msg("error get many")
 	}
 	return
 }
 
-func ExistS(log zerolog.Logger, con *sqlx.DB, table string, where []string) (bool, error) {
+func ExistS(log zerolog.Logger, con sqlx.QueryerContext, table string, where []string) (bool, error) {
+	return ExistSCtx(context.Background(), log, con, table, where)
+}
+
+func ExistSCtx(ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, table string, where []string) (ret bool, err error) {
+	ctx, span := startDBSpan(ctx, con, "SELECT", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	where = softDeleteS(ctx, table, where)
 	var cnt int
-	query, args, _ := Psql.Select("count(*)").From(table).Where(AndWhere(where)).ToSql()
-	row := con.QueryRow(query, args...)
-	err := row.Scan(&cnt)
+	query, args, _ := d.Builder().Select("count(*)").From(d.Ident(table)).Where(AndWhere(where)).ToSql()
+	spanStatement(span, sq.Expr(query))
+	err = con.QueryRowxContext(ctx, query, args...).Scan(&cnt)
 	if err != nil {
-		log.Err(err).Str("query", query).Interface("args", args).Str("table", table).Msg("error delete")
+		log.Err(err).Str("query", query).Interface("args", args).Str("table", table).Msg("error check exist")
 	}
 	return cnt > 0, err
 }
 
 func Delete(log zerolog.Logger, con sq.BaseRunner, table string, where []string) (err error) {
+	return DeleteCtx(context.Background(), log, con, table, where)
+}
+
+func DeleteCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, where []string) (err error) {
+	if cfg, ok := auditOf(ctx, table); ok && len(where) != 0 {
+		return audited(ctx, log, con, table, cfg, []sq.Sqlizer{sq.Expr(AndWhere(where))}, false, func(ctx context.Context, tx TxRunner) error {
+			return DeleteCtx(ctx, log, tx, table, where)
+		})
+	}
+	ctx, span := startDBSpan(ctx, con, "DELETE", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
 	if len(where) == 0 {
 		return nil
 	}
-	if _, err = Psql.Delete(table).Where(AndWhere(where)).RunWith(con).Exec(); err != nil {
+	q := d.Builder().Delete(d.Ident(table)).Where(AndWhere(where))
+	spanStatement(span, q)
+	if _, err = q.RunWith(con).ExecContext(ctx); err != nil {
 		log.Err(err).Strs("where", where).Str("table", table).Msg("error delete")
 	}
 	return err
 }
 
-func ListFlex[T any](log zerolog.Logger, con *sqlx.DB, page Page, table string, selects, where, orderby []string) (ret []T, total int, err error) {
+func ListFlex[T any](log zerolog.Logger, con sqlx.QueryerContext, page Page, table string, selects, where, orderby []string) (ret []T, total int, err error) {
+	return ListFlexCtx[T](context.Background(), log, con, page, table, selects, where, orderby)
+}
+
+func ListFlexCtx[T any](ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, page Page, table string, selects, where, orderby []string) (ret []T, total int, err error) {
+	ctx, span := startDBSpan(ctx, con, "SELECT", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
 	ret = []T{}
 	var toSelect = "*"
-	where = append(where, "1=1")
+	where = append(softDeleteS(ctx, table, where), "1=1")
 	orderby = append(orderby, "(SELECT NULL)")
 	if len(selects) != 0 {
 		toSelect = strings.Join(selects, ",")
@@ -139,71 +353,81 @@ func ListFlex[T any](log zerolog.Logger, con *sqlx.DB, page Page, table string,
 
 	w := strings.Join(where, " AND ")
 	o := strings.Join(orderby, ",")
-	query, args, _ := Psql.Select(toSelect).From(table).
+	base := d.Builder().Select(toSelect).From(d.Ident(table)).
 		Where(w).
-		OrderBy(o).
-		Offset(page.Offset()).
-		Limit(page.Limit()).
-		ToSql()
+		OrderBy(o)
+	query, args, _ := d.Paginate(base, page).ToSql()
+	spanStatement(span, sq.Expr(query))
 
 	ret = make([]T, 0)
-	if err = con.Select(&ret, query, args...); err != nil {
+	if err = selectContext(ctx, con, &ret, query, args...); err != nil {
 		log.Err(err).Str("table", table).Str("query", query).Interface("args", args).Msg("error select")
 		return
 	}
 
-	err = Psql.Select("COUNT(*)").
-		From(table).
+	countQuery, countArgs, _ := d.Builder().Select("COUNT(*)").
+		From(d.Ident(table)).
 		Where(w).
-		RunWith(con).
-		QueryRow().Scan(&total)
-	if err != nil {
+		ToSql()
+	if err = con.QueryRowxContext(ctx, countQuery, countArgs...).Scan(&total); err != nil {
 		log.Err(err).Str("table", table).Str("query", query).Interface("args", args).Msg("error get count")
 	}
 
-	if table == "common.product" {
-		log.Info().Str("query", query).Interface("args", args).Msg("list flex")
-	}
-
 	return
 }
 
-func ListM[T any](log zerolog.Logger, con *sqlx.DB, page Page, table string, where map[string]any, orderBy []string) (ret []T, total int, err error) {
+func ListM[T any](log zerolog.Logger, con sqlx.QueryerContext, page Page, table string, where map[string]any, orderBy []string) (ret []T, total int, err error) {
+	return ListMCtx[T](context.Background(), log, con, page, table, where, orderBy)
+}
+
+func ListMCtx[T any](ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, page Page, table string, where map[string]any, orderBy []string) (ret []T, total int, err error) {
+	ctx, span := startDBSpan(ctx, con, "SELECT", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
 	ret = []T{}
 
-	base := Psql.Select("*").From(table)
+	base := d.Builder().Select("*").From(d.Ident(table))
+	sd := softDeleteM(ctx, table, where)
 
 	if len(where) != 0 {
 		base = base.Where(where)
 	}
+	base = whereSoftDelete(base, sd)
 	if len(orderBy) != 0 {
 		base = base.OrderBy(strings.Join(orderBy, ","))
 	}
 
-	query, args, _ := base.
-		Offset(page.Offset()).
-		Limit(page.Limit()).
-		ToSql()
+	query, args, _ := d.Paginate(base, page).ToSql()
+	spanStatement(span, sq.Expr(query))
 
-	if err = con.Select(&ret, query, args...); err != nil {
+	if err = selectContext(ctx, con, &ret, query, args...); err != nil {
 		log.Err(err).Str("table", table).Str("query", query).Interface("args", args).Msg("error select")
 		return
 	}
 
-	err = Psql.Select("COUNT(*)").From(table).Where(where).
-		RunWith(con).QueryRow().Scan(&total)
-	if err != nil {
+	query, args, _ = whereSoftDelete(d.Builder().Select("COUNT(*)").From(d.Ident(table)).Where(where), sd).ToSql()
+	if err = con.QueryRowxContext(ctx, query, args...).Scan(&total); err != nil {
 		log.Err(err).Str("table", table).Msg("error count total")
 	}
 	return
 }
 
 func UpdateMore(log zerolog.Logger, con sq.BaseRunner, table string, ids []int, sets map[string]any) (err error) {
-	_, err = Psql.Update(table).
+	return UpdateMoreCtx(context.Background(), log, con, table, ids, sets)
+}
+
+func UpdateMoreCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, ids []int, sets map[string]any) (err error) {
+	ctx, span := startDBSpan(ctx, con, "UPDATE", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	if err = d.Check(FeatureUpdate); err != nil {
+		return
+	}
+	q := d.Builder().Update(d.Ident(table)).
 		SetMap(sets).
-		Where(sq.Eq{"id": ids}).
-		RunWith(con).
-		Exec()
+		Where(sq.Eq{"id": ids})
+	spanStatement(span, q)
+	_, err = q.RunWith(con).ExecContext(ctx)
 	if err != nil {
 		log.Err(err).Ints("id", ids).Str("table", table).Interface("updates", sets).Msg("error update more")
 	}
@@ -211,28 +435,81 @@ func UpdateMore(log zerolog.Logger, con sq.BaseRunner, table string, ids []int,
 }
 
 func UpdateM(log zerolog.Logger, con sq.BaseRunner, table string, where map[string]any, sets map[string]any) (err error) {
-	_, err = Psql.Update(table).
+	return UpdateMCtx(context.Background(), log, con, table, where, sets)
+}
+
+func UpdateMCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, where map[string]any, sets map[string]any) (err error) {
+	if cfg, ok := auditOf(ctx, table); ok {
+		return audited(ctx, log, con, table, cfg, []sq.Sqlizer{sq.Eq(where)}, false, func(ctx context.Context, tx TxRunner) error {
+			return UpdateMCtx(ctx, log, tx, table, where, sets)
+		})
+	}
+	ctx, span := startDBSpan(ctx, con, "UPDATE", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	if err = d.Check(FeatureUpdate); err != nil {
+		return
+	}
+	vcfg, versioned := versionOf(table)
+	expected, checked := expectedVersion(ctx)
+	if versioned {
+		// the version only moves forward by itself
+		sets = Filterm(sets, func(col string, _ any) bool { return col != vcfg.Column })
+	}
+	q := d.Builder().Update(d.Ident(table)).
 		SetMap(sets).
-		Where(where).
-		RunWith(con).
-		Exec()
+		Where(where)
+	if versioned {
+		q = q.Set(vcfg.Column, vcfg.next())
+		if checked {
+			q = q.Where(sq.Eq{vcfg.Column: expected})
+		}
+	}
+	spanStatement(span, q)
+	res, err := q.RunWith(con).ExecContext(ctx)
 	if err != nil {
 		log.Err(err).Interface("where", where).Str("table", table).Interface("updates", sets).Msg("error update")
+		return err
 	}
-	return err
+	if versioned && checked {
+		if n, _ := res.RowsAffected(); n == 0 {
+			return versionConflict(ctx, log, con, table, where, vcfg)
+		}
+	}
+	return nil
 }
 
 func UpdateWithID(log zerolog.Logger, con sq.BaseRunner, table string, id int, sets map[string]any) (err error) {
+	return UpdateWithIDCtx(context.Background(), log, con, table, id, sets)
+}
+
+func UpdateWithIDCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, id int, sets map[string]any) (err error) {
 	where := Obj{"id": id}
-	return UpdateM(log, con, table, where, sets)
+	return UpdateMCtx(ctx, log, con, table, where, sets)
 }
 
 func SetDelete(log zerolog.Logger, con *sqlx.DB, table string, id int, del bool) (err error) {
-	_, err = Psql.
-		Update(table).
+	return SetDeleteCtx(context.Background(), log, con, table, id, del)
+}
+
+// SetDeleteCtx flips is_deleted, or the column registered for table by RegisterSoftDelete
+func SetDeleteCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, id int, del bool) (err error) {
+	ctx, span := startDBSpan(ctx, con, "UPDATE", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	if err = d.Check(FeatureUpdate); err != nil {
+		return
+	}
+	cfg, ok := softDeleteOf(table)
+	if !ok {
+		cfg.SetDefault()
+	}
+	q := d.Builder().
+		Update(d.Ident(table)).
 		Where(sq.Eq{"id": id}).
-		Set("is_deleted", del).
-		RunWith(con).Exec()
+		Set(cfg.Column, cfg.mark(del))
+	spanStatement(span, q)
+	_, err = q.RunWith(con).ExecContext(ctx)
 	if err != nil {
 		log.Err(err).Int("id", id).Bool("del", del).Str("table", table).Msg("error set delete")
 	}
@@ -240,11 +517,22 @@ func SetDelete(log zerolog.Logger, con *sqlx.DB, table string, id int, del bool)
 }
 
 func SetActive(log zerolog.Logger, con *sqlx.DB, table string, id int, active bool) (err error) {
-	_, err = Psql.
-		Update(table).
+	return SetActiveCtx(context.Background(), log, con, table, id, active)
+}
+
+func SetActiveCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, id int, active bool) (err error) {
+	ctx, span := startDBSpan(ctx, con, "UPDATE", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	if err = d.Check(FeatureUpdate); err != nil {
+		return
+	}
+	q := d.Builder().
+		Update(d.Ident(table)).
 		Where(sq.Eq{"id": id}).
-		Set("is_active", active).
-		RunWith(con).Exec()
+		Set("is_active", active)
+	spanStatement(span, q)
+	_, err = q.RunWith(con).ExecContext(ctx)
 	if err != nil {
 		log.Err(err).Int("id", id).Bool("active", active).Msg("error set active")
 	}
@@ -253,38 +541,71 @@ func SetActive(log zerolog.Logger, con *sqlx.DB, table string, id int, active bo
 
 type PartitionFunc func(runner sq.BaseRunner, table string) error
 
+type PartitionFuncCtx func(ctx context.Context, runner sq.BaseRunner, table string) error
+
+// withCtx adapts a PartitionFunc to the ctx-first signature, nil stays nil
+func (p PartitionFunc) withCtx() PartitionFuncCtx {
+	if p == nil {
+		return nil
+	}
+	return func(_ context.Context, runner sq.BaseRunner, table string) error {
+		return p(runner, table)
+	}
+}
+
 func CreateManySkip[T any](log zerolog.Logger, con sq.BaseRunner, table string, reqs []T, returning, skipping []string, partitionFunc PartitionFunc) (ids []int, err error) {
+	return CreateManySkipCtx(context.Background(), log, con, table, reqs, returning, skipping, partitionFunc.withCtx())
+}
+
+func CreateManySkipCtx[T any](ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, reqs []T, returning, skipping []string, partitionFunc PartitionFuncCtx) (ids []int, err error) {
+	ctx, span := startDBSpan(ctx, con, "INSERT", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
 	if len(reqs) == 0 {
 		return
 	}
+	if len(returning) != 0 {
+		if err = d.Check(FeatureReturning); err != nil {
+			return
+		}
+	}
 	if partitionFunc != nil {
-		if err = partitionFunc(con, table); err != nil {
+		if err = partitionFunc(ctx, con, table); err != nil {
 			return
 		}
 	}
 
 	cols, _ := ExtractTags(reqs[0], "db", skipping)
 
-	base := Psql.Insert(table).Columns(cols...)
-	if len(returning) != 0 {
-		base = base.Suffix("RETURNING " + strings.Join(returning, ","))
-	}
+	base := d.Builder().Insert(d.Ident(table)).Columns(d.Idents(cols)...)
 	for _, req := range reqs {
 		_, vals := ExtractTags(req, "db", skipping)
 		base = base.Values(vals...)
 	}
+	if cfg, ok := auditOf(ctx, table); ok {
+		return auditedCreate(ctx, log, con, table, cfg, base, returning)
+	}
+	if len(returning) != 0 {
+		base = base.Suffix("RETURNING " + strings.Join(returning, ","))
+	}
 
-	query, args, err := base.ToSql()
-	if err != nil {
+	spanStatement(span, base)
+	if len(returning) == 0 {
+		if _, err = base.RunWith(con).ExecContext(ctx); err != nil {
+			query, _, _ := base.ToSql()
+			log.Err(err).Str("query", query).Msg("error create many")
+		}
 		return
 	}
-	rows, err := con.Query(query, args...)
+
+	rows, err := base.RunWith(con).QueryContext(ctx)
 	defer func() {
 		if rows != nil {
 			_ = rows.Close()
 		}
 	}()
 	if err != nil {
+		query, _, _ := base.ToSql()
 		log.Err(err).Str("query", query).Msg("error create many")
 		return
 	}
@@ -296,6 +617,7 @@ func CreateManySkip[T any](log zerolog.Logger, con sq.BaseRunner, table string,
 		}
 		ids = append(ids, id)
 	}
+	err = rows.Err()
 	return
 }
 
@@ -303,22 +625,48 @@ func CreateMany[T any](log zerolog.Logger, con sq.BaseRunner, table string, reqs
 	return CreateManySkip[T](log, con, table, reqs, returning, []string{}, partitionFunc)
 }
 
+func CreateManyCtx[T any](ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, reqs []T, returning []string, partitionFunc PartitionFuncCtx) (ids []int, err error) {
+	return CreateManySkipCtx[T](ctx, log, con, table, reqs, returning, []string{}, partitionFunc)
+}
+
 func CreateSkip[T any](log zerolog.Logger, con sq.BaseRunner, table string, req T, returning, skipping []string, partitionFunc PartitionFunc) (id int, err error) {
+	return CreateSkipCtx(context.Background(), log, con, table, req, returning, skipping, partitionFunc.withCtx())
+}
+
+func CreateSkipCtx[T any](ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, req T, returning, skipping []string, partitionFunc PartitionFuncCtx) (id int, err error) {
+	if _, ok := auditOf(ctx, table); ok {
+		ids, err := CreateManySkipCtx(ctx, log, con, table, []T{req}, returning, skipping, partitionFunc)
+		if len(ids) != 0 {
+			id = ids[0]
+		}
+		return id, err
+	}
+	ctx, span := startDBSpan(ctx, con, "INSERT", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	if len(returning) != 0 {
+		if err = d.Check(FeatureReturning); err != nil {
+			return
+		}
+	}
 	if partitionFunc != nil {
-		if err = partitionFunc(con, table); err != nil {
+		if err = partitionFunc(ctx, con, table); err != nil {
 			return
 		}
 	}
 
 	cols, vals := ExtractTags(req, "db", skipping)
-	base := Psql.Insert(table).
-		Columns(cols...).
+	base := d.Builder().Insert(d.Ident(table)).
+		Columns(d.Idents(cols)...).
 		Values(vals...)
 	if len(returning) != 0 {
 		base = base.Suffix("RETURNING " + strings.Join(returning, ","))
-		err = base.RunWith(con).QueryRow().Scan(&id)
+	}
+	spanStatement(span, base)
+	if len(returning) != 0 {
+		err = base.RunWith(con).QueryRowContext(ctx).Scan(&id)
 	} else {
-		_, err = base.RunWith(con).Exec()
+		_, err = base.RunWith(con).ExecContext(ctx)
 	}
 	if err != nil {
 		log.Err(err).Interface("req", req).Str("table", table).Msg("error create")
@@ -330,27 +678,51 @@ func Create[T any](log zerolog.Logger, con sq.BaseRunner, table string, req T, r
 	return CreateSkip[T](log, con, table, req, returning, []string{}, partitionFunc)
 }
 
-func GetManyM[T any](log zerolog.Logger, con *sqlx.DB, table string, where map[string]any, orderby []string) (ret []T, err error) {
+func CreateCtx[T any](ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, req T, returning []string, partitionFunc PartitionFuncCtx) (id int, err error) {
+	return CreateSkipCtx[T](ctx, log, con, table, req, returning, []string{}, partitionFunc)
+}
+
+func GetManyM[T any](log zerolog.Logger, con sqlx.QueryerContext, table string, where map[string]any, orderby []string) (ret []T, err error) {
+	return GetManyMCtx[T](context.Background(), log, con, table, where, orderby)
+}
+
+func GetManyMCtx[T any](ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, table string, where map[string]any, orderby []string) (ret []T, err error) {
+	ctx, span := startDBSpan(ctx, con, "SELECT", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
 	ret = []T{}
 	tmp := make([]T, 1)
 	cols, _ := ExtractTags(tmp[0], "db", nil)
-	query, args, _ := Psql.Select(cols...).From(table).
-		Where(where).
-		OrderBy(strings.Join(orderby, ",")).
-		ToSql()
-	if err = con.Select(&ret, query, args...); err != nil {
+	base := whereSoftDelete(d.Builder().Select(d.Idents(cols)...).From(d.Ident(table)).Where(where), softDeleteM(ctx, table, where))
+	query, args, _ := base.OrderBy(strings.Join(orderby, ",")).ToSql()
+	spanStatement(span, sq.Expr(query))
+	if err = selectContext(ctx, con, &ret, query, args...); err != nil {
 		log.Err(err).Type("type", ret).Interface("where", where).Str("table", table).Msg("error get")
 	}
 	return
 }
 
-func GetM[T any](log zerolog.Logger, con *sqlx.DB, table string, where map[string]any) (ret T, err error) {
+func GetM[T any](log zerolog.Logger, con sqlx.QueryerContext, table string, where map[string]any) (ret T, err error) {
+	return GetMCtx[T](context.Background(), log, con, table, where)
+}
+
+func GetMCtx[T any](ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, table string, where map[string]any) (ret T, err error) {
+	return getM[T](ctx, log, con, table, where, "")
+}
+
+func getM[T any](ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, table string, where map[string]any, suffix string) (ret T, err error) {
+	ctx, span := startDBSpan(ctx, con, "SELECT", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
 	tmp := make([]T, 1)
 	cols, _ := ExtractTags(tmp[0], "db", nil)
-	query, args, _ := Psql.Select(cols...).From(table).
-		Where(where).
-		ToSql()
-	row := con.QueryRowx(query, args...)
+	base := whereSoftDelete(d.Builder().Select(d.Idents(cols)...).From(d.Ident(table)).Where(where), softDeleteM(ctx, table, where))
+	if suffix != "" {
+		base = base.Suffix(suffix)
+	}
+	query, args, _ := base.ToSql()
+	spanStatement(span, sq.Expr(query))
+	row := con.QueryRowxContext(ctx, query, args...)
 	if err = row.StructScan(&ret); err != nil {
 		log.Err(err).Type("type", ret).Interface("where", where).Str("table", table).Msg("error get")
 		if err == sql.ErrNoRows {
@@ -363,13 +735,20 @@ func GetM[T any](log zerolog.Logger, con *sqlx.DB, table string, where map[strin
 	return
 }
 
-func ExistM(log zerolog.Logger, con *sqlx.DB, table string, where map[string]any) (ret bool, err error) {
-	query, args, _ := Psql.Select("COUNT(*)").From(table).
-		Where(where).
+func ExistM(log zerolog.Logger, con sqlx.QueryerContext, table string, where map[string]any) (ret bool, err error) {
+	return ExistMCtx(context.Background(), log, con, table, where)
+}
+
+func ExistMCtx(ctx context.Context, log zerolog.Logger, con sqlx.QueryerContext, table string, where map[string]any) (ret bool, err error) {
+	ctx, span := startDBSpan(ctx, con, "SELECT", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	query, args, _ := whereSoftDelete(d.Builder().Select("COUNT(*)").From(d.Ident(table)).Where(where), softDeleteM(ctx, table, where)).
 		ToSql()
 
 	var cnt int
-	if err = con.QueryRow(query, args...).Scan(&cnt); err != nil {
+	spanStatement(span, sq.Expr(query))
+	if err = con.QueryRowxContext(ctx, query, args...).Scan(&cnt); err != nil {
 		log.Err(err).Interface("where", where).Str("table", table).Msg("error check exist")
 	}
 	ret = cnt > 0
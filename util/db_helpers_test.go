@@ -1,6 +1,8 @@
 package util
 
 import (
+	"context"
+	"strings"
 	"testing"
 
 	"github.com/rs/zerolog"
@@ -20,3 +22,97 @@ func TestGet(t *testing.T) {
 	_, err = GetM[row](zerolog.Logger{}, db, "test", map[string]any{"a": 1})
 	assert.NotNil(t, err)
 }
+
+func TestHelpersCtx(t *testing.T) {
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	_, err := db.Exec("CREATE TABLE test (id serial primary key, a int, b int)")
+	assert.Nil(t, err)
+
+	type row struct {
+		A int `db:"a"`
+		B int `db:"b"`
+	}
+
+	ctx := context.Background()
+	id, err := CreateCtx(ctx, zerolog.Logger{}, db, "test", row{A: 1, B: 2}, []string{"id"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, id)
+
+	assert.Nil(t, UpsertManyCtx(ctx, zerolog.Logger{}, db, "test", []string{"id"}, "db", []struct {
+		ID int `db:"id"`
+		A  int `db:"a"`
+	}{{ID: 1, A: 10}}, nil, nil))
+
+	tx, err := db.Beginx()
+	assert.Nil(t, err)
+	got, err := GetMCtx[row](ctx, zerolog.Logger{}, tx, "test", map[string]any{"id": id})
+	assert.Nil(t, err)
+	assert.Equal(t, row{A: 10, B: 2}, got)
+	assert.Nil(t, tx.Rollback())
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = ListSCtx[row](canceled, zerolog.Logger{}, db, NoPagination, "test", nil, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, UpdateMCtx(canceled, zerolog.Logger{}, db, "test", map[string]any{"id": id}, map[string]any{"a": 3}), context.Canceled)
+}
+
+func TestUpsertManyCount(t *testing.T) {
+	type row struct {
+		ID int `db:"id"`
+		A  int `db:"a"`
+	}
+	l, queries := recordQueries(t)
+	ctx := context.Background()
+
+	// two columns a row, the placeholder limit splits them in two batches
+	rows := make([]row, 30000)
+	ret, err := UpsertManyCountCtx(ctx, zerolog.Logger{}, l, "test", []string{"id"}, "db", rows, nil, nil)
+	assert.Nil(t, err)
+	// the fake driver returns one row per query
+	assert.Equal(t, UpsertManyResult{
+		UpsertResult: UpsertResult{Inserted: 2},
+		Batches:      []UpsertResult{{Inserted: 1}, {Inserted: 1}},
+	}, ret)
+	executed := queries()
+	assert.Len(t, executed, 2)
+	for _, q := range executed {
+		assert.True(t, strings.HasSuffix(q, "ON CONFLICT (id) DO UPDATE SET a=excluded.a RETURNING (xmax = 0)"))
+	}
+
+	ret, err = UpsertManyCountCtx[row](ctx, zerolog.Logger{}, l, "test", []string{"id"}, "db", nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, UpsertManyResult{}, ret)
+	assert.Empty(t, queries())
+}
+
+func TestUpsertManyReturning(t *testing.T) {
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	_, err := db.Exec("CREATE TABLE test (id serial primary key, code text unique, a int)")
+	assert.Nil(t, err)
+	_, err = db.Exec("INSERT INTO test (code, a) VALUES ('x', 1)")
+	assert.Nil(t, err)
+
+	type row struct {
+		Code string `db:"code"`
+		A    int    `db:"a"`
+	}
+	type returned struct {
+		ID   int    `db:"id"`
+		Code string `db:"code"`
+	}
+	ctx := context.Background()
+	toInsert := []row{{Code: "x", A: 2}, {Code: "y", A: 3}}
+	got, ret, err := UpsertManyReturningCtx[row, returned](ctx, zerolog.Logger{}, db, "test", []string{"code"}, "db", toInsert, nil, []string{"id", "code"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []returned{{ID: 1, Code: "x"}, {ID: 2, Code: "y"}}, got)
+	assert.Equal(t, UpsertResult{Inserted: 1, Updated: 1}, ret.UpsertResult)
+	assert.Len(t, ret.Batches, 1)
+
+	ids, _, err := UpsertManyReturningCtx[row, int](ctx, zerolog.Logger{}, db, "test", []string{"code"}, "db", toInsert, nil, []string{"id"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2}, ids)
+
+	_, _, err = UpsertManyReturningCtx[row, returned](ctx, zerolog.Logger{}, db, "test", []string{"code"}, "db", toInsert, nil, []string{"a"}, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,176 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+)
+
+var ErrUnsupportedByDialect = errors.New("unsupported by dialect")
+
+type DialectFeature string
+
+const (
+	FeatureUpsert    DialectFeature = "upsert"
+	FeatureReturning DialectFeature = "returning"
+	FeatureUpdate    DialectFeature = "update"
+	FeatureRowLock   DialectFeature = "row lock"
+	FeaturePartition DialectFeature = "partition"
+)
+
+// Dialect captures the differences in SQL between the databases openDBByURL can return
+type Dialect struct {
+	Name        string
+	Placeholder sq.PlaceholderFormat
+	quote       string
+	unsupported []DialectFeature
+}
+
+var (
+	PostgresDialect = Dialect{
+		Name:        "postgres",
+		Placeholder: sq.Dollar,
+		quote:       `"`,
+	}
+	ClickhouseDialect = Dialect{
+		Name:        "clickhouse",
+		Placeholder: sq.Question,
+		quote:       "`",
+		// updates are asynchronous mutations and there is no ON CONFLICT,
+		// upserts are left to ReplacingMergeTree style engines
+		unsupported: []DialectFeature{FeatureUpsert, FeatureReturning, FeatureUpdate, FeatureRowLock, FeaturePartition},
+	}
+)
+
+func DialectByDriver(driverName string) (Dialect, error) {
+	switch driverName {
+	case "postgres", "pgx":
+		return PostgresDialect, nil
+	case "clickhouse":
+		return ClickhouseDialect, nil
+	default:
+		return Dialect{}, fmt.Errorf("no dialect for driver %s", driverName)
+	}
+}
+
+// DialectOf picks the dialect from the DriverName of *sqlx.DB, *sqlx.Tx and alike,
+// anything else is assumed to be postgres as the helpers always did
+func DialectOf(con any) Dialect {
+	if named, ok := con.(interface{ DriverName() string }); ok {
+		if d, err := DialectByDriver(named.DriverName()); err == nil {
+			return d
+		}
+	}
+	return PostgresDialect
+}
+
+func (d Dialect) Builder() sq.StatementBuilderType {
+	return sq.StatementBuilder.PlaceholderFormat(d.Placeholder)
+}
+
+// Check returns an ErrUnsupportedByDialect error when the feature is not available
+func (d Dialect) Check(feature DialectFeature) error {
+	if Contains(feature, d.unsupported) {
+		return fmt.Errorf("%w: %s on %s", ErrUnsupportedByDialect, feature, d.Name)
+	}
+	return nil
+}
+
+// Quote quotes every part of a possibly schema qualified identifier
+func (d Dialect) Quote(ident string) string {
+	parts := strings.Split(ident, ".")
+	for i, p := range parts {
+		parts[i] = d.quote + strings.ReplaceAll(p, d.quote, d.quote+d.quote) + d.quote
+	}
+	return strings.Join(parts, ".")
+}
+
+// reservedWords can not be used as plain identifiers
+var reservedWords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`all analyse analyze and any array as asc asymmetric both case cast check collate
+		column constraint create current_catalog current_date current_role current_time current_timestamp current_user
+		default deferrable desc distinct do else end except false fetch for foreign from grant group having in initially
+		intersect into lateral leading limit localtime localtimestamp not null offset on only or order placing primary
+		references returning select session_user some symmetric table then to trailing true union unique user using
+		variadic when where window with`) {
+		reservedWords[w] = true
+	}
+}
+
+// Ident renders the table and column names of the statements the helpers build. Reserved words, like user
+// or order, and names a plain identifier can not hold are quoted, the other names are left as they are so
+// the statements keep matching case folded DDL. A name that is not a dotted name, e.g. an expression or a
+// table with an alias, is left alone.
+func (d Dialect) Ident(name string) string {
+	if name == "" || strings.ContainsAny(name, " \t\n()*,'\"`") {
+		return name
+	}
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		switch {
+		case !plainIdent(p):
+			parts[i] = d.Quote(p)
+		case reservedWords[strings.ToLower(p)]:
+			parts[i] = d.Quote(strings.ToLower(p))
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func (d Dialect) Idents(names []string) []string {
+	return Map(names, d.Ident)
+}
+
+func plainIdent(s string) bool {
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && (c == '$' || c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// UpsertSuffix is the statement suffix turning an insert of cols into an upsert on pks
+func (d Dialect) UpsertSuffix(cols, pks []string, mergeStrategy map[string]string) (string, error) {
+	if err := d.Check(FeatureUpsert); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s",
+		strings.Join(d.Idents(pks), ","),
+		d.updateClause(cols, pks, mergeStrategy)), nil
+}
+
+// updateClause is UpdateClause with the columns rendered by Ident, mergeStrategy is keyed by the plain names
+func (d Dialect) updateClause(headers, pks []string, mergeStrategy map[string]string) string {
+	var tmp []string
+	for _, update := range Except(headers, pks) {
+		col := d.Ident(update)
+		if val, ok := mergeStrategy[update]; ok {
+			tmp = append(tmp, fmt.Sprintf("%s=%s", col, val))
+		} else {
+			tmp = append(tmp, fmt.Sprintf("%s=excluded.%s", col, col))
+		}
+	}
+	return strings.Join(tmp, ", ")
+}
+
+// ArrayArg binds a slice as a single array parameter
+func (d Dialect) ArrayArg(array any) any {
+	if d.Name == PostgresDialect.Name {
+		return pq.Array(array)
+	}
+	return array
+}
+
+// Paginate applies the page, an unpaginated page leaves LIMIT and OFFSET out entirely
+func (d Dialect) Paginate(b sq.SelectBuilder, page Page) sq.SelectBuilder {
+	if page.Off {
+		return b
+	}
+	return b.Offset(page.Offset()).Limit(page.Limit())
+}
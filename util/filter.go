@@ -0,0 +1,167 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/labstack/echo/v4"
+)
+
+// FilterOps are the operators understood by ParseFilter
+var FilterOps = []string{"eq", "ne", "gt", "gte", "lt", "lte", "in", "nin", "like", "ilike", "null"}
+
+// ParseFilter compiles `status:eq:active,created_at:gte:2024-01-01,id:in:1|2|3` into a predicate.
+// Fields are whitelisted by the db tags of T and values are coerced to the go type of the field,
+// problems are reported as one ErrBadRequest carrying every offending expression in Data.
+func ParseFilter[T any](expr string) (sq.Sqlizer, error) {
+	ret := sq.And{}
+	if expr == "" {
+		return ret, nil
+	}
+
+	tags, zeros := ExtractTags(*new(T), "db", nil)
+	types := make(map[string]reflect.Type, len(tags))
+	for i, tag := range tags {
+		types[tag] = reflect.TypeOf(zeros[i])
+	}
+
+	var problems []StrMap
+	for _, part := range strings.Split(expr, ",") {
+		pred, err := parseFilterPart(part, types)
+		if err != nil {
+			problems = append(problems, StrMap{"filter": part, "error": err.Error()})
+			continue
+		}
+		ret = append(ret, pred)
+	}
+	if len(problems) != 0 {
+		return nil, NewErr(http.StatusBadRequest, "invalid filter", problems)
+	}
+	return ret, nil
+}
+
+// GetFilter parses the `filter` query param against the db tags of T
+func GetFilter[T any](ctx echo.Context) (sq.Sqlizer, error) {
+	return ParseFilter[T](ctx.QueryParam("filter"))
+}
+
+func parseFilterPart(part string, types map[string]reflect.Type) (sq.Sqlizer, error) {
+	// the value is the remainder, so timestamps can keep their colons
+	tokens := strings.SplitN(part, ":", 3)
+	if len(tokens) != 3 {
+		return nil, fmt.Errorf("expect field:op:value")
+	}
+	field, op, raw := tokens[0], tokens[1], tokens[2]
+
+	typ, ok := types[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s", field)
+	}
+	if !Contains(op, FilterOps) {
+		return nil, fmt.Errorf("unknown operator %s", op)
+	}
+
+	switch op {
+	case "null":
+		isNull, err := To[bool](raw)
+		if err != nil {
+			return nil, fmt.Errorf("null expects true or false")
+		}
+		if isNull {
+			return sq.Eq{field: nil}, nil
+		}
+		return sq.NotEq{field: nil}, nil
+	case "in", "nin":
+		var vals []any
+		for _, r := range strings.Split(raw, "|") {
+			v, err := coerceFilterValue(typ, r)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, v)
+		}
+		if op == "in" {
+			return sq.Eq{field: vals}, nil
+		}
+		return sq.NotEq{field: vals}, nil
+	case "like", "ilike":
+		if indirectType(typ).Kind() != reflect.String {
+			return nil, fmt.Errorf("%s only applies to text fields", op)
+		}
+		if op == "like" {
+			return sq.Like{field: raw}, nil
+		}
+		return sq.ILike{field: raw}, nil
+	}
+
+	v, err := coerceFilterValue(typ, raw)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "eq":
+		return sq.Eq{field: v}, nil
+	case "ne":
+		return sq.NotEq{field: v}, nil
+	case "gt":
+		return sq.Gt{field: v}, nil
+	case "gte":
+		return sq.GtOrEq{field: v}, nil
+	case "lt":
+		return sq.Lt{field: v}, nil
+	default:
+		return sq.LtOrEq{field: v}, nil
+	}
+}
+
+func indirectType(typ reflect.Type) reflect.Type {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
+// coerceFilterValue converts raw to the (dereferenced) field type with To
+func coerceFilterValue(typ reflect.Type, raw string) (ret any, err error) {
+	typ = indirectType(typ)
+	switch {
+	case typ == reflect.TypeOf(time.Time{}):
+		ret, err = To[time.Time](raw)
+	case typ.Kind() == reflect.String:
+		return reflect.ValueOf(raw).Convert(typ).Interface(), nil
+	case typ.Kind() == reflect.Bool:
+		ret, err = To[bool](raw)
+	case reflect.Int <= typ.Kind() && typ.Kind() <= reflect.Int64:
+		var n int
+		if n, err = To[int](raw); err == nil {
+			if reflect.Zero(typ).OverflowInt(int64(n)) {
+				return nil, fmt.Errorf("%s value %q out of range", typ, raw)
+			}
+			ret = reflect.ValueOf(n).Convert(typ).Interface()
+		}
+	case reflect.Uint <= typ.Kind() && typ.Kind() <= reflect.Uint64:
+		// converting a negative int would wrap around to a huge value
+		var n int
+		if n, err = To[int](raw); err == nil {
+			if n < 0 || reflect.Zero(typ).OverflowUint(uint64(n)) {
+				return nil, fmt.Errorf("%s value %q out of range", typ, raw)
+			}
+			ret = reflect.ValueOf(n).Convert(typ).Interface()
+		}
+	case typ.Kind() == reflect.Float32 || typ.Kind() == reflect.Float64:
+		ret, err = To[float64](raw)
+		if err == nil {
+			ret = reflect.ValueOf(ret).Convert(typ).Interface()
+		}
+	default:
+		return nil, fmt.Errorf("filtering on %s is not supported", typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value %q", typ, raw)
+	}
+	return
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type filterRow struct {
+	ID        int        `db:"id"`
+	Count     uint       `db:"count"`
+	Level     int8       `db:"level"`
+	Status    string     `db:"status"`
+	Score     float64    `db:"score"`
+	CreatedAt time.Time  `db:"created_at"`
+	DeletedAt *time.Time `db:"deleted_at"`
+	Secret    string     `json:"secret"`
+}
+
+func TestParseFilter(t *testing.T) {
+	pred, err := ParseFilter[filterRow]("status:eq:active,created_at:gte:2024-01-01T00:00:00Z,id:in:1|2|3,deleted_at:null:true")
+	assert.Nil(t, err)
+	query, args, err := pred.ToSql()
+	assert.Nil(t, err)
+	assert.Equal(t, "(status = ? AND created_at >= ? AND id IN (?,?,?) AND deleted_at IS NULL)", query)
+	assert.Equal(t, []any{"active", DateUTC(2024, 1, 1), 1, 2, 3}, args)
+
+	pred, err = ParseFilter[filterRow]("score:lt:1.5,status:ilike:%act%")
+	assert.Nil(t, err)
+	query, args, err = pred.ToSql()
+	assert.Nil(t, err)
+	assert.Equal(t, "(score < ? AND status ILIKE ?)", query)
+	assert.Equal(t, []any{1.5, "%act%"}, args)
+
+	pred, err = ParseFilter[filterRow]("count:gte:3")
+	assert.Nil(t, err)
+	_, args, _ = pred.ToSql()
+	assert.Equal(t, []any{uint(3)}, args)
+
+	pred, err = ParseFilter[filterRow]("")
+	assert.Nil(t, err)
+	query, _, err = pred.ToSql()
+	assert.Nil(t, err)
+	assert.Equal(t, "(1=1)", query)
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	_, err := ParseFilter[filterRow]("secret:eq:x,id:between:1,id:eq:abc,status,score:like:1,count:gt:-1,level:in:1|300")
+	e, ok := err.(Err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, e.Code)
+	assert.Equal(t, []StrMap{
+		{"filter": "secret:eq:x", "error": "unknown field secret"},
+		{"filter": "id:between:1", "error": "unknown operator between"},
+		{"filter": "id:eq:abc", "error": `invalid int value "abc"`},
+		{"filter": "status", "error": "expect field:op:value"},
+		{"filter": "score:like:1", "error": "like only applies to text fields"},
+		{"filter": "count:gt:-1", "error": `uint value "-1" out of range`},
+		{"filter": "level:in:1|300", "error": `int8 value "300" out of range`},
+	}, e.Data)
+}
@@ -25,6 +25,7 @@ var CustomErrHandler = func(e *echo.Echo) func(err error, c echo.Context) {
 	return func(err error, c echo.Context) {
 		// Check if the error is your custom error type
 		if e, ok := err.(Err); ok {
+			setConflictETag(c, e)
 			// Write to context or modify response based on custom error
 			e1 := c.JSON(e.Code, map[string]any{"message": e.Msg, "data": fmt.Sprintf("%+v", e.Data)})
 			if e1 != nil {
@@ -84,6 +85,7 @@ func RespJSON(ctx echo.Context, err error, payload any) error {
 
 func errHandle(ctx echo.Context, err error) error {
 	if e, ok := err.(Err); ok {
+		setConflictETag(ctx, e)
 		return ctx.JSON(e.Code, e)
 	}
 	switch err {
@@ -128,11 +130,23 @@ func buildReq(method, rawURL string, query, header map[string]string, data any,
 }
 
 func doReq[RESP any](client *http.Client, req *http.Request) (ret RESP, err error) {
+	req, span := startHTTPSpan(req)
+	status, start := 0, time.Now()
+	defer func() {
+		endHTTPSpan(span, status, err)
+		label := "error"
+		if status != 0 {
+			label = strconv.Itoa(status)
+		}
+		httpClientDuration.Observe(time.Since(start).Seconds(), req.URL.Host, label)
+	}()
+
 	resp, err := client.Do(req)
 	if err != nil {
 		return ret, err
 	}
 	defer func() { _ = resp.Body.Close() }()
+	status = resp.StatusCode
 
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -10,9 +10,11 @@ func ParseJwtToken(jwtToken string, jwtParsers ...JwtParser) (ret UserPayload, e
 	var parseErrs []string
 	for _, parser := range jwtParsers {
 		if ret, err = parser.TokenToPayload(jwtToken); err != nil {
+			jwtParseTotal.Inc(fmt.Sprintf("%T", parser), "failure")
 			parseErrs = append(parseErrs, fmt.Sprintf("%T: %v", parser, err))
 			continue
 		}
+		jwtParseTotal.Inc(fmt.Sprintf("%T", parser), "success")
 		return
 	}
 	if len(parseErrs) != 0 {
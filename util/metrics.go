@@ -0,0 +1,332 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// DefaultBuckets are the histogram buckets in seconds for request latencies
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics is the registry the built-in collectors of this package report to
+var Metrics = NewRegistry()
+
+var (
+	httpClientDuration = Metrics.NewHistogram("http_client_request_duration_seconds",
+		"Latency of outbound Request and RequestCtx calls.", DefaultBuckets, "host", "status")
+	jwtParseTotal = Metrics.NewCounter("jwt_parse_total",
+		"ParseJwtToken attempts by parser and outcome.", "parser", "outcome")
+)
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+type series struct {
+	labels []string
+	value  float64
+	// buckets holds the non-cumulative count per bucket of a histogram, the last one is +Inf
+	buckets []uint64
+	count   uint64
+}
+
+type metric struct {
+	name    string
+	help    string
+	typ     metricType
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func (m *metric) get(labels []string) *series {
+	if len(labels) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labels), len(labels)))
+	}
+	key := strings.Join(labels, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: slices.Clone(labels)}
+		if m.typ == histogramType {
+			s.buckets = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+type Counter struct{ m *metric }
+
+// Add increases the series of the label values by v, v must not be negative
+func (c Counter) Add(v float64, labels ...string) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.m.get(labels).value += v
+}
+
+func (c Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// SetTotal sets the series of the label values to v, for totals counted elsewhere and read in a Collect,
+// e.g. from sql.DBStats. A v lower than before is taken as a reset by Prometheus.
+func (c Counter) SetTotal(v float64, labels ...string) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.m.get(labels).value = v
+}
+
+type Gauge struct{ m *metric }
+
+func (g Gauge) Set(v float64, labels ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(labels).value = v
+}
+
+func (g Gauge) Add(v float64, labels ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(labels).value += v
+}
+
+type Histogram struct{ m *metric }
+
+func (h Histogram) Observe(v float64, labels ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	s := h.m.get(labels)
+	s.buckets[sort.SearchFloat64s(h.m.buckets, v)]++
+	s.count++
+	s.value += v
+}
+
+// Registry holds metrics and renders them in the Prometheus text format
+type Registry struct {
+	mu         sync.Mutex
+	metrics    map[string]*metric
+	collectors []func()
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]*metric{}}
+}
+
+// register returns the metric already registered under name when the definition matches,
+// so packages can declare the same metric twice
+func (r *Registry) register(name, help string, typ metricType, buckets []float64, labels []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		if m.typ != typ || !slices.Equal(m.labels, labels) {
+			panic(fmt.Sprintf("metric %s already registered as %s%v", name, m.typ, m.labels))
+		}
+		return m
+	}
+	m := &metric{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	r.metrics[name] = m
+	return m
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) Counter {
+	return Counter{r.register(name, help, counterType, nil, labels)}
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) Gauge {
+	return Gauge{r.register(name, help, gaugeType, nil, labels)}
+}
+
+// NewHistogram takes the upper bounds of the buckets in ascending order, +Inf is added
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) Histogram {
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("buckets of %s are not sorted", name))
+	}
+	return Histogram{r.register(name, help, histogramType, buckets, labels)}
+}
+
+// Collect registers fn to run before every scrape, e.g. to set gauges from a snapshot
+func (r *Registry) Collect(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, fn)
+}
+
+// WriteTo renders every metric, sorted by name and label values
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	metrics := make([]*metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.Unlock()
+
+	for _, fn := range collectors {
+		fn()
+	}
+	slices.SortFunc(metrics, func(a, b *metric) int { return strings.Compare(a.name, b.name) })
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		m.write(cw)
+	}
+	err := cw.w.Flush()
+	return cw.n, err
+}
+
+// Handler serves the registry to the Prometheus scraper
+func (r *Registry) Handler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+		c.Response().WriteHeader(http.StatusOK)
+		_, err := r.WriteTo(c.Response())
+		return err
+	}
+}
+
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countingWriter) printf(format string, args ...any) {
+	n, _ := fmt.Fprintf(c.w, format, args...)
+	c.n += int64(n)
+}
+
+func (m *metric) write(w *countingWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.printf("# HELP %s %s\n", m.name, escapeHelp(m.help))
+	w.printf("# TYPE %s %s\n", m.name, m.typ)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.typ != histogramType {
+			w.printf("%s%s %s\n", m.name, labelPairs(m.labels, s.labels, "", ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, cnt := range s.buckets {
+			cumulative += cnt
+			le := math.Inf(1)
+			if i < len(m.buckets) {
+				le = m.buckets[i]
+			}
+			w.printf("%s_bucket%s %d\n", m.name, labelPairs(m.labels, s.labels, "le", formatFloat(le)), cumulative)
+		}
+		w.printf("%s_sum%s %s\n", m.name, labelPairs(m.labels, s.labels, "", ""), formatFloat(s.value))
+		w.printf("%s_count%s %d\n", m.name, labelPairs(m.labels, s.labels, "", ""), s.count)
+	}
+}
+
+func labelPairs(names, values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabel(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// CollectDBStats reports the pool of db labelled with name at every scrape of r,
+// compare db_in_use_connections to db_max_open_connections for the saturation
+func CollectDBStats(r *Registry, name string, db *sqlx.DB) {
+	maxOpen := r.NewGauge("db_max_open_connections", "Maximum number of open connections of the pool.", "db")
+	open := r.NewGauge("db_open_connections", "Established connections, in use and idle.", "db")
+	inUse := r.NewGauge("db_in_use_connections", "Connections currently in use.", "db")
+	idle := r.NewGauge("db_idle_connections", "Idle connections.", "db")
+	waitCount := r.NewCounter("db_wait_count_total", "Total number of connections waited for.", "db")
+	waitDuration := r.NewCounter("db_wait_duration_seconds_total", "Total time blocked waiting for a connection.", "db")
+	closedIdle := r.NewCounter("db_max_idle_closed_total", "Total connections closed due to the idle limits.", "db")
+	closedLifetime := r.NewCounter("db_max_lifetime_closed_total", "Total connections closed due to ConnMaxLifetime.", "db")
+
+	r.Collect(func() {
+		s := db.Stats()
+		maxOpen.Set(float64(s.MaxOpenConnections), name)
+		open.Set(float64(s.OpenConnections), name)
+		inUse.Set(float64(s.InUse), name)
+		idle.Set(float64(s.Idle), name)
+		waitCount.SetTotal(float64(s.WaitCount), name)
+		waitDuration.SetTotal(s.WaitDuration.Seconds(), name)
+		closedIdle.SetTotal(float64(s.MaxIdleClosed+s.MaxIdleTimeClosed), name)
+		closedLifetime.SetTotal(float64(s.MaxLifetimeClosed), name)
+	})
+}
+
+// MetricsMiddleware counts the requests and their latency per route and status on r
+func MetricsMiddleware(r *Registry) echo.MiddlewareFunc {
+	total := r.NewCounter("http_requests_total", "Handled requests by route and status.", "method", "route", "status")
+	duration := r.NewHistogram("http_request_duration_seconds", "Latency of the handled requests.", DefaultBuckets, "method", "route")
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			start := time.Now()
+			err = next(c)
+			duration.Observe(time.Since(start).Seconds(), c.Request().Method, c.Path())
+			total.Inc(c.Request().Method, c.Path(), strconv.Itoa(responseStatus(c, err)))
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package util
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	buf := bytes.Buffer{}
+	_, err := r.WriteTo(&buf)
+	assert.Nil(t, err)
+	return buf.String()
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("jobs_total", "Processed jobs.", "queue")
+	c.Inc("a")
+	c.Add(2, "a")
+	c.Inc(`b"\`)
+	g := r.NewGauge("temperature", "Current\ntemperature.")
+	g.Set(21.5)
+	g.Add(-0.5)
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	assert.Equal(t, `# HELP jobs_total Processed jobs.
+# TYPE jobs_total counter
+jobs_total{queue="a"} 3
+jobs_total{queue="b\"\\"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.55
+latency_seconds_count 3
+# HELP temperature Current\ntemperature.
+# TYPE temperature gauge
+temperature 21
+`, scrape(t, r))
+
+	// the same definition returns the registered metric, a different one panics
+	r.NewCounter("jobs_total", "Processed jobs.", "queue").Inc("a")
+	assert.Contains(t, scrape(t, r), `jobs_total{queue="a"} 4`)
+	assert.Panics(t, func() { r.NewGauge("jobs_total", "") })
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { r.NewHistogram("h", "", []float64{1, 0.5}) })
+}
+
+func TestCollectDBStats(t *testing.T) {
+	r := NewRegistry()
+	db := sqlx.NewDb(sql.OpenDB(fakeConnector{}), "pgx")
+	db.SetMaxOpenConns(7)
+	CollectDBStats(r, "main", db)
+
+	out := scrape(t, r)
+	assert.Contains(t, out, `db_max_open_connections{db="main"} 7`)
+	assert.Contains(t, out, `db_in_use_connections{db="main"} 0`)
+	assert.Contains(t, out, "# TYPE db_wait_count_total counter")
+	assert.Contains(t, out, `db_wait_duration_seconds_total{db="main"} 0`)
+
+	conn, err := db.Conn(t.Context())
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Contains(t, scrape(t, r), `db_in_use_connections{db="main"} 1`)
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	r := NewRegistry()
+	e := echo.New()
+	e.Use(MetricsMiddleware(r))
+	e.GET("/users/:id", func(c echo.Context) error {
+		if c.Param("id") == "0" {
+			return NewErr(http.StatusNotFound, "not found", nil)
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/metrics", r.Handler())
+
+	for _, id := range []string{"1", "2", "0"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/"+id, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), "text/plain; version=0.0.4"))
+	out := rec.Body.String()
+	assert.Contains(t, out, `http_requests_total{method="GET",route="/users/:id",status="200"} 2`)
+	assert.Contains(t, out, `http_requests_total{method="GET",route="/users/:id",status="404"} 1`)
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="GET",route="/users/:id"} 3`)
+}
+
+func TestRequestMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer srv.Close()
+
+	_, err := Request[map[string]any](http.MethodGet, srv.URL, nil, nil, nil, 0)
+	assert.NotNil(t, err)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	assert.Contains(t, scrape(t, Metrics), `http_client_request_duration_seconds_count{host="`+host+`",status="418"} 1`)
+
+	_, err = Request[map[string]any](http.MethodGet, "http://127.0.0.1:1", nil, nil, nil, 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, scrape(t, Metrics), `http_client_request_duration_seconds_count{host="127.0.0.1:1",status="error"} 1`)
+}
+
+type metricsTestParser struct{ ok bool }
+
+func (p metricsTestParser) TokenToPayload(string) (ret UserPayload, err error) {
+	if !p.ok {
+		err = errors.New("invalid token")
+	}
+	return
+}
+
+func TestJwtMetrics(t *testing.T) {
+	_, err := ParseJwtToken("token", metricsTestParser{}, metricsTestParser{ok: true})
+	assert.Nil(t, err)
+
+	out := scrape(t, Metrics)
+	assert.Contains(t, out, `jwt_parse_total{parser="util.metricsTestParser",outcome="failure"} 1`)
+	assert.Contains(t, out, `jwt_parse_total{parser="util.metricsTestParser",outcome="success"} 1`)
+}
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+    id         bigserial PRIMARY KEY,
+    table_name text        NOT NULL,
+    pk         jsonb       NOT NULL,
+    op         text        NOT NULL,
+    before     jsonb,
+    after      jsonb,
+    actor      text        NOT NULL DEFAULT '',
+    at         timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_row_idx ON audit_log (table_name, pk, at);
@@ -0,0 +1,337 @@
+package util
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/clickhouse"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/rs/zerolog"
+)
+
+const MigrationChecksumTable = "schema_migrations_checksum"
+
+var ErrMigrationChecksum = errors.New("applied migration was modified")
+
+var migrationChecksumDDL = map[string]string{
+	PostgresDialect.Name: "CREATE TABLE IF NOT EXISTS " + MigrationChecksumTable +
+		" (version bigint PRIMARY KEY, checksum text NOT NULL, applied_at timestamptz NOT NULL DEFAULT now())",
+	ClickhouseDialect.Name: "CREATE TABLE IF NOT EXISTS " + MigrationChecksumTable +
+		" (version Int64, checksum String, applied_at DateTime DEFAULT now()) ENGINE = ReplacingMergeTree ORDER BY version",
+}
+
+// MigrationDir reads migrations from a directory on disk, what Migrate and Migrate2 always did
+func MigrationDir(dir string) (source.Driver, error) {
+	return (&file.File{}).Open("file://" + dir)
+}
+
+// MigrationFS reads migrations from dir inside fsys, typically an embed.FS shipped in the binary
+func MigrationFS(fsys fs.FS, dir string) (source.Driver, error) {
+	return iofs.New(fsys, dir)
+}
+
+type MigrationStatus struct {
+	// Version is the last applied migration, 0 when nothing is applied
+	Version uint   `json:"version"`
+	Dirty   bool   `json:"dirty"`
+	Pending []uint `json:"pending"`
+}
+
+// Migrator wraps golang-migrate and keeps a sha256 of every applied up migration,
+// migrating refuses to run when an applied file no longer matches its checksum.
+// Migrations applied before the checksums were kept are adopted as they are.
+type Migrator struct {
+	log     zerolog.Logger
+	db      *sql.DB
+	dialect Dialect
+	src     source.Driver
+	m       *migrate.Migrate
+}
+
+// NewMigrator takes ownership of src, Close closes both src and db
+func NewMigrator(log zerolog.Logger, dbType string, db *sql.DB, dbName string, src source.Driver) (ret *Migrator, err error) {
+	dialect, err := DialectByDriver(dbType)
+	if err != nil {
+		return
+	}
+	// before the driver takes a connection, a failure leaves nothing to release
+	if _, err = db.Exec(migrationChecksumDDL[dialect.Name]); err != nil {
+		return
+	}
+
+	var driver database.Driver
+	switch dialect.Name {
+	case PostgresDialect.Name:
+		driver, err = postgres.WithInstance(db, &postgres.Config{})
+	case ClickhouseDialect.Name:
+		driver, err = clickhouse.WithInstance(db, &clickhouse.Config{MultiStatementEnabled: true})
+	}
+	if err != nil {
+		return
+	}
+
+	m, err := migrate.NewWithInstance("source", src, dbName, driver)
+	if err != nil {
+		return
+	}
+
+	return &Migrator{
+		log:     log,
+		db:      db,
+		dialect: dialect,
+		src:     src,
+		m:       m,
+	}, nil
+}
+
+// Up applies all pending migrations
+func (m *Migrator) Up() error {
+	return m.run(m.m.Up)
+}
+
+// MigrateTo migrates up or down to version
+func (m *Migrator) MigrateTo(version uint) error {
+	return m.run(func() error { return m.m.Migrate(version) })
+}
+
+// Steps applies n migrations, or rolls back -n of them when n is negative
+func (m *Migrator) Steps(n int) error {
+	return m.run(func() error { return m.m.Steps(n) })
+}
+
+// Down rolls back all applied migrations
+func (m *Migrator) Down() error {
+	return m.run(m.m.Down)
+}
+
+// Force sets the version without running anything and clears the dirty flag,
+// the checksums are re-recorded so a file fixed after a failed migration is accepted
+func (m *Migrator) Force(version int) (err error) {
+	if err = m.m.Force(version); err != nil {
+		return
+	}
+	cur, _, err := m.version()
+	if err != nil {
+		return
+	}
+	if err = m.forget(cur); err != nil {
+		return
+	}
+	return m.record()
+}
+
+func (m *Migrator) Status() (ret MigrationStatus, err error) {
+	if ret.Version, ret.Dirty, err = m.version(); err != nil {
+		return
+	}
+	versions, err := migrationVersions(m.src)
+	if err != nil {
+		return
+	}
+	for _, v := range versions {
+		if v > ret.Version {
+			ret.Pending = append(ret.Pending, v)
+		}
+	}
+	return
+}
+
+// Verify compares the applied migrations against their recorded checksums
+func (m *Migrator) Verify() error {
+	cur, _, err := m.version()
+	if err != nil {
+		return err
+	}
+	recorded, err := m.recorded()
+	if err != nil {
+		return err
+	}
+	versions, err := migrationVersions(m.src)
+	if err != nil {
+		return err
+	}
+
+	for v := range recorded {
+		if v <= cur && !slices.Contains(versions, v) {
+			return fmt.Errorf("%w: migration %d is missing from the source", ErrMigrationChecksum, v)
+		}
+	}
+	for _, v := range versions {
+		expected, ok := recorded[v]
+		if v > cur || !ok {
+			continue
+		}
+		sum, identifier, err := migrationChecksum(m.src, v)
+		if err != nil {
+			return err
+		}
+		if sum != expected {
+			return fmt.Errorf("%w: migration %d_%s", ErrMigrationChecksum, v, identifier)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) Close() error {
+	srcErr, dbErr := m.m.Close()
+	return errors.Join(srcErr, dbErr)
+}
+
+// run verifies the checksums, runs fn and records the checksums of the new version,
+// migrate.ErrNoChange is not an error
+func (m *Migrator) run(fn func() error) (err error) {
+	if err = m.Verify(); err != nil {
+		m.log.Err(err).Msg("error verify migrations")
+		return
+	}
+	if err = fn(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		m.log.Err(err).Msg("error migrate")
+		return
+	}
+	if err = m.record(); err != nil {
+		m.log.Err(err).Msg("error record migration checksums")
+	}
+	return
+}
+
+func (m *Migrator) version() (version uint, dirty bool, err error) {
+	version, dirty, err = m.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, nil
+	}
+	return
+}
+
+func (m *Migrator) recorded() (ret map[uint]string, err error) {
+	from := MigrationChecksumTable
+	if m.dialect.Name == ClickhouseDialect.Name {
+		from += " FINAL"
+	}
+	rows, err := m.dialect.Builder().Select("version", "checksum").From(from).
+		Where("checksum != ''").RunWith(m.db).Query()
+	if err != nil {
+		return
+	}
+	defer func() { _ = rows.Close() }()
+
+	ret = map[uint]string{}
+	for rows.Next() {
+		var version int64
+		var sum string
+		if err = rows.Scan(&version, &sum); err != nil {
+			return
+		}
+		ret[uint(version)] = sum
+	}
+	return ret, rows.Err()
+}
+
+// forget drops the checksums of from and the later versions. Deletes are asynchronous mutations on
+// clickhouse, there a replacing row with an empty checksum hides the version instead.
+func (m *Migrator) forget(from uint) (err error) {
+	if m.dialect.Name != ClickhouseDialect.Name {
+		_, err = m.dialect.Builder().Delete(MigrationChecksumTable).Where("version >= ?", int64(from)).RunWith(m.db).Exec()
+		return
+	}
+	recorded, err := m.recorded()
+	if err != nil {
+		return
+	}
+	for v := range recorded {
+		if v < from {
+			continue
+		}
+		if err = m.insertChecksum(v, ""); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (m *Migrator) insertChecksum(version uint, sum string) (err error) {
+	_, err = m.dialect.Builder().Insert(MigrationChecksumTable).
+		Columns("version", "checksum").
+		Values(int64(version), sum).
+		RunWith(m.db).
+		Exec()
+	return
+}
+
+// record drops the checksums of rolled back migrations and adds the missing ones up to the current version
+func (m *Migrator) record() (err error) {
+	cur, dirty, err := m.version()
+	if err != nil || dirty {
+		return
+	}
+	if err = m.forget(cur + 1); err != nil {
+		return
+	}
+
+	recorded, err := m.recorded()
+	if err != nil {
+		return
+	}
+	versions, err := migrationVersions(m.src)
+	if err != nil {
+		return
+	}
+	for _, v := range versions {
+		if _, ok := recorded[v]; ok || v > cur {
+			continue
+		}
+		sum, _, err := migrationChecksum(m.src, v)
+		if err != nil {
+			return err
+		}
+		if sum == "" {
+			// a down only version has nothing to verify, and an empty checksum marks a forgotten one
+			continue
+		}
+		if err = m.insertChecksum(v, sum); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+// migrationVersions lists every version of src in ascending order
+func migrationVersions(src source.Driver) (ret []uint, err error) {
+	v, err := src.First()
+	for err == nil {
+		ret = append(ret, v)
+		v, err = src.Next(v)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return
+}
+
+// migrationChecksum is the sha256 of the up migration, a version with only a down file has none
+func migrationChecksum(src source.Driver, version uint) (sum, identifier string, err error) {
+	r, identifier, err := src.ReadUp(version)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", identifier, nil
+	}
+	if err != nil {
+		return
+	}
+	defer func() { _ = r.Close() }()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, r); err != nil {
+		return
+	}
+	return hex.EncodeToString(h.Sum(nil)), identifier, nil
+}
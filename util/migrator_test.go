@@ -0,0 +1,109 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMigrations() fstest.MapFS {
+	return fstest.MapFS{
+		"sql/1_init.up.sql":        {Data: []byte("CREATE TABLE migrator_a (id int);")},
+		"sql/1_init.down.sql":      {Data: []byte("DROP TABLE migrator_a;")},
+		"sql/2_more.up.sql":        {Data: []byte("CREATE TABLE migrator_b (id int);")},
+		"sql/2_more.down.sql":      {Data: []byte("DROP TABLE migrator_b;")},
+		"sql/3_only_down.down.sql": {Data: []byte("SELECT 1;")},
+	}
+}
+
+func TestMigrationSource(t *testing.T) {
+	src, err := MigrationFS(testMigrations(), "sql")
+	assert.Nil(t, err)
+
+	versions, err := migrationVersions(src)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint{1, 2, 3}, versions)
+
+	sum, identifier, err := migrationChecksum(src, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "init", identifier)
+	assert.Len(t, sum, 64)
+
+	sum, _, err = migrationChecksum(src, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, "", sum)
+
+	edited := testMigrations()
+	edited["sql/1_init.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE migrator_a (id bigint);")}
+	src2, err := MigrationFS(edited, "sql")
+	assert.Nil(t, err)
+	sum1, _, _ := migrationChecksum(src, 1)
+	sum2, _, _ := migrationChecksum(src2, 1)
+	assert.NotEqual(t, sum1, sum2)
+
+	empty, err := MigrationFS(fstest.MapFS{"sql/readme.md": {}}, "sql")
+	assert.Nil(t, err)
+	versions, err = migrationVersions(empty)
+	assert.Nil(t, err)
+	assert.Empty(t, versions)
+}
+
+func TestMigrator(t *testing.T) {
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	src, err := MigrationFS(testMigrations(), "sql")
+	assert.Nil(t, err)
+	m, err := NewMigrator(LOG, "postgres", db.DB, "test", src)
+	assert.Nil(t, err)
+	defer func() { _ = m.Close() }()
+
+	status, err := m.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, MigrationStatus{Version: 0, Pending: []uint{1, 2, 3}}, status)
+
+	assert.Nil(t, m.MigrateTo(2))
+	assert.Nil(t, m.Up())
+	status, err = m.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(3), status.Version)
+	assert.Empty(t, status.Pending)
+	// nothing left is not an error
+	assert.Nil(t, m.Up())
+
+	assert.Nil(t, m.Steps(-2))
+	status, err = m.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, MigrationStatus{Version: 1, Pending: []uint{2, 3}}, status)
+
+	assert.Nil(t, m.Force(2))
+	status, _ = m.Status()
+	assert.Equal(t, uint(2), status.Version)
+	assert.Nil(t, m.Down())
+
+	// apply, then edit an applied file
+	assert.Nil(t, m.MigrateTo(1))
+	edited := testMigrations()
+	edited["sql/1_init.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE migrator_a (id bigint);")}
+	src2, err := MigrationFS(edited, "sql")
+	assert.Nil(t, err)
+	m2, err := NewMigrator(LOG, "postgres", db.DB, "test", src2)
+	assert.Nil(t, err)
+	err = m2.Up()
+	assert.True(t, errors.Is(err, ErrMigrationChecksum))
+}
+
+func TestMigrateKeepsNoChecksums(t *testing.T) {
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "1_init.up.sql"), []byte("CREATE TABLE migrate_a (id int);"), 0o644))
+
+	assert.Nil(t, Migrate("postgres", db.DB, "test", dir))
+	assert.ErrorIs(t, Migrate("postgres", db.DB, "test", dir), migrate.ErrNoChange)
+	var exists bool
+	assert.Nil(t, db.Get(&exists, "SELECT to_regclass($1) IS NOT NULL", MigrationChecksumTable))
+	assert.False(t, exists)
+}
@@ -0,0 +1,543 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+)
+
+// PartitionInfo is a partition of a table as found in pg_inherits
+type PartitionInfo struct {
+	Schema string `db:"schema"`
+	Name   string `db:"name"`
+	// Bound is the partition bound, e.g. FOR VALUES FROM ('2024-01-01 00:00:00+00') TO ('2024-02-01 00:00:00+00')
+	Bound string `db:"bound"`
+	// Rows is the row estimate of the last analyze, 0 before any
+	Rows int64 `db:"rows"`
+	// Size is the size in bytes including indexes and toast
+	Size int64 `db:"size"`
+}
+
+func (p PartitionInfo) Table() string {
+	return p.Schema + "." + p.Name
+}
+
+func (p PartitionInfo) IsDefault() bool {
+	return p.Bound == "DEFAULT"
+}
+
+// Partitions lists the partitions of parent ordered by name
+func Partitions(ctx context.Context, con sqlx.QueryerContext, parent string) (ret []PartitionInfo, err error) {
+	if err = DialectOf(con).Check(FeaturePartition); err != nil {
+		return
+	}
+	ret = []PartitionInfo{}
+	err = selectContext(ctx, con, &ret, `
+		SELECT n.nspname AS schema, c.relname AS name, pg_get_expr(c.relpartbound, c.oid) AS bound,
+			GREATEST(c.reltuples, 0)::bigint AS rows, pg_total_relation_size(c.oid) AS size
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE i.inhparent = $1::regclass
+		ORDER BY c.relname`, parent)
+	return
+}
+
+var rangeBoundRe = regexp.MustCompile(`^FOR VALUES FROM \('([^']+)'\) TO \('([^']+)'\)$`)
+
+var boundTimeFormats = []string{"2006-01-02 15:04:05.999999-07", "2006-01-02 15:04:05.999999-07:00", "2006-01-02 15:04:05.999999", "2006-01-02"}
+
+// timeRange parses the bound of a range partition on a single date or timestamp column
+func (p PartitionInfo) timeRange() (from, to time.Time, ok bool) {
+	m := rangeBoundRe.FindStringSubmatch(p.Bound)
+	if m == nil {
+		return
+	}
+	from, okFrom := parseBoundTime(m[1])
+	to, okTo := parseBoundTime(m[2])
+	return from, to, okFrom && okTo
+}
+
+func parseBoundTime(s string) (time.Time, bool) {
+	for _, layout := range boundTimeFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+type PartitionManagerConfig struct {
+	// Parent is the table partitioned by range on a date or timestamp column
+	Parent string `validate:"required"`
+	// Level is the period of a partition, day, week or month
+	Level AggLevel `validate:"oneof=day week month"`
+	// Schema the partitions are created in, default the one of Parent or public
+	Schema string
+	// Ahead is how many periods after the current one are created, default 3
+	Ahead int
+	// Retention is how many periods before the current one are kept, 0 keeps everything
+	Retention int
+	// ArchiveSchema receives the detached partitions instead of dropping them
+	ArchiveSchema string
+	// Interval is how often Run maintains the partitions, default 1h
+	Interval time.Duration
+}
+
+func (c *PartitionManagerConfig) SetDefault() {
+	if c.Schema == "" {
+		c.Schema = "public"
+		if schema, _, ok := strings.Cut(c.Parent, "."); ok {
+			c.Schema = schema
+		}
+	}
+	if c.Ahead <= 0 {
+		c.Ahead = 3
+	}
+	if c.Interval <= 0 {
+		c.Interval = time.Hour
+	}
+}
+
+// PartitionReport is what a run of the PartitionManager did, by partition name
+type PartitionReport struct {
+	Created  []string `json:"created"`
+	Dropped  []string `json:"dropped"`
+	Archived []string `json:"archived"`
+}
+
+// PartitionManager keeps the partitions of a table partitioned by time: the current period and the
+// following ones exist before rows arrive, and partitions out of the retention are detached and dropped or archived.
+// Partitions are named after the parent and the start of their period, e.g. events_p20240101.
+type PartitionManager struct {
+	log zerolog.Logger
+	db  *sqlx.DB
+	cfg PartitionManagerConfig
+	now func() time.Time
+}
+
+func NewPartitionManager(log zerolog.Logger, db *sqlx.DB, cfg PartitionManagerConfig) (*PartitionManager, error) {
+	cfg.SetDefault()
+	if err := Validator.Struct(cfg); err != nil {
+		return nil, err
+	}
+	if err := DialectOf(db).Check(FeaturePartition); err != nil {
+		return nil, err
+	}
+	return &PartitionManager{
+		log: log.With().Str("parent", cfg.Parent).Logger(),
+		db:  db,
+		cfg: cfg,
+		now: time.Now,
+	}, nil
+}
+
+// partitionName is the name of the partition of the period starting at from
+func (p *PartitionManager) partitionName(from time.Time) string {
+	_, short, ok := strings.Cut(p.cfg.Parent, ".")
+	if !ok {
+		short = p.cfg.Parent
+	}
+	layout := "20060102"
+	if p.cfg.Level == LevelMonth {
+		layout = "200601"
+	}
+	return short + "_p" + from.Format(layout)
+}
+
+func (p *PartitionManager) periodStart(offset int) time.Time {
+	start := Truncate(p.now().UTC(), p.cfg.Level)
+	switch p.cfg.Level {
+	case LevelMonth:
+		return start.AddDate(0, offset, 0)
+	case LevelWeek:
+		return start.AddDate(0, 0, 7*offset)
+	default:
+		return start.AddDate(0, 0, offset)
+	}
+}
+
+func boundLiteral(t time.Time) string {
+	return "'" + t.UTC().Format("2006-01-02 15:04:05") + "+00'"
+}
+
+// Maintain creates the missing partitions and retires the expired ones once, errors of single
+// partitions do not stop the others and are returned joined
+func (p *PartitionManager) Maintain(ctx context.Context) (ret PartitionReport, err error) {
+	existing, err := Partitions(ctx, p.db, p.cfg.Parent)
+	if err != nil {
+		p.log.Err(err).Msg("error list partitions")
+		return
+	}
+	covered := func(from, to time.Time) bool {
+		for _, e := range existing {
+			if f, t, ok := e.timeRange(); ok && f.Before(to) && from.Before(t) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var errs []error
+	for i := 0; i <= p.cfg.Ahead; i++ {
+		from, to := p.periodStart(i), p.periodStart(i+1)
+		if covered(from, to) {
+			continue
+		}
+		name := p.cfg.Schema + "." + p.partitionName(from)
+		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM (%s) TO (%s)",
+			name, p.cfg.Parent, boundLiteral(from), boundLiteral(to))
+		if _, e := p.db.ExecContext(ctx, query); e != nil {
+			p.log.Err(e).Str("partition", name).Msg("error create partition")
+			errs = append(errs, e)
+			continue
+		}
+		ret.Created = append(ret.Created, name)
+	}
+
+	if p.cfg.Retention > 0 {
+		cutoff := p.periodStart(-p.cfg.Retention)
+		for _, e := range existing {
+			if _, to, ok := e.timeRange(); !ok || to.After(cutoff) {
+				continue
+			}
+			if err := p.retire(ctx, e); err != nil {
+				p.log.Err(err).Str("partition", e.Table()).Msg("error retire partition")
+				errs = append(errs, err)
+				continue
+			}
+			if p.cfg.ArchiveSchema != "" {
+				ret.Archived = append(ret.Archived, e.Table())
+			} else {
+				ret.Dropped = append(ret.Dropped, e.Table())
+			}
+		}
+	}
+
+	err = errors.Join(errs...)
+	p.log.Info().
+		Strs("created", ret.Created).
+		Strs("dropped", ret.Dropped).
+		Strs("archived", ret.Archived).
+		Bool("failed", err != nil).
+		Msg("partitions maintained")
+	return
+}
+
+// retire detaches the partition and drops or archives it in one transaction
+func (p *PartitionManager) retire(ctx context.Context, part PartitionInfo) error {
+	return WithTxRunner(ctx, p.db, TxOptions{}, func(tx TxRunner) (err error) {
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", p.cfg.Parent, part.Table())); err != nil {
+			return
+		}
+		if p.cfg.ArchiveSchema != "" {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s SET SCHEMA %s", part.Table(), p.cfg.ArchiveSchema))
+			return
+		}
+		_, err = tx.ExecContext(ctx, "DROP TABLE "+part.Table())
+		return
+	})
+}
+
+// Run maintains the partitions right away and then every Interval until ctx is done, start it in a goroutine
+func (p *PartitionManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		// failures are logged by Maintain and retried on the next tick
+		_, _ = p.Maintain(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type PartitionKind string
+
+const (
+	PartitionRange PartitionKind = "range"
+	PartitionList  PartitionKind = "list"
+	PartitionHash  PartitionKind = "hash"
+)
+
+// PartitionBoundValue leaves a side of a range partition unbounded
+type PartitionBoundValue string
+
+const (
+	PartitionMinValue PartitionBoundValue = "MINVALUE"
+	PartitionMaxValue PartitionBoundValue = "MAXVALUE"
+)
+
+// PartitionSpec is the partition Name of Parent, its Kind must be the one of the parent
+type PartitionSpec struct {
+	Kind   PartitionKind
+	Name   string
+	Parent string
+	// From and To bound a range partition, one value per column of the partition key
+	From, To []any
+	// Values are those of a list partition, nil stands for NULL
+	Values []any
+	// Modulus and Remainder select the rows of a hash partition
+	Modulus, Remainder int
+	// Default makes the partition receive the rows no other partition of a range or list parent accepts
+	Default bool
+}
+
+// Bound renders the partition bound, e.g. FOR VALUES WITH (MODULUS 4, REMAINDER 1)
+func (s PartitionSpec) Bound() string {
+	if s.Default {
+		return "DEFAULT"
+	}
+	switch s.Kind {
+	case PartitionRange:
+		return fmt.Sprintf("FOR VALUES FROM (%s) TO (%s)", partitionLiterals(s.From), partitionLiterals(s.To))
+	case PartitionList:
+		return fmt.Sprintf("FOR VALUES IN (%s)", partitionLiterals(s.Values))
+	default:
+		return fmt.Sprintf("FOR VALUES WITH (MODULUS %d, REMAINDER %d)", s.Modulus, s.Remainder)
+	}
+}
+
+// SQL is the statement creating the partition
+func (s PartitionSpec) SQL() string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s %s", s.Name, s.Parent, s.Bound())
+}
+
+// check renders the condition of the rows of the partition on the key columns cols. As a CHECK constraint
+// of the table it lets postgres skip scanning it on attach.
+func (s PartitionSpec) check(cols []string, parentOID int64) (string, error) {
+	notNull := Map(cols, func(c string) string { return c + " IS NOT NULL" })
+	switch s.Kind {
+	case PartitionRange:
+		if len(s.From) != len(cols) || len(s.To) != len(cols) {
+			return "", ErrBadRequest(fmt.Sprintf("range of %s needs a value per key column %v", s.Name, cols))
+		}
+		if len(cols) == 1 {
+			conds := notNull
+			if _, unbounded := s.From[0].(PartitionBoundValue); !unbounded {
+				conds = append(conds, cols[0]+" >= "+partitionLiteral(s.From[0]))
+			}
+			if _, unbounded := s.To[0].(PartitionBoundValue); !unbounded {
+				conds = append(conds, cols[0]+" < "+partitionLiteral(s.To[0]))
+			}
+			return strings.Join(conds, " AND "), nil
+		}
+		for _, v := range append(slices.Clone(s.From), s.To...) {
+			if _, unbounded := v.(PartitionBoundValue); unbounded {
+				return "", ErrBadRequest(fmt.Sprintf("unbounded range of %s on several columns is not supported", s.Name))
+			}
+		}
+		key := "(" + strings.Join(cols, ", ") + ")"
+		return strings.Join(append(notNull,
+			key+" >= ("+partitionLiterals(s.From)+")",
+			key+" < ("+partitionLiterals(s.To)+")"), " AND "), nil
+	case PartitionList:
+		if len(cols) != 1 {
+			return "", ErrBadRequest(fmt.Sprintf("list of %s needs a single key column, got %v", s.Name, cols))
+		}
+		values := Filter(s.Values, func(v any) bool { return v != nil })
+		in := cols[0] + " IN (" + partitionLiterals(values) + ")"
+		switch {
+		case len(values) == len(s.Values):
+			return notNull[0] + " AND " + in, nil
+		case len(values) == 0:
+			return cols[0] + " IS NULL", nil
+		default:
+			return "(" + cols[0] + " IS NULL OR " + in + ")", nil
+		}
+	case PartitionHash:
+		return fmt.Sprintf("satisfies_hash_partition(%d, %d, %d, %s)", parentOID, s.Modulus, s.Remainder, strings.Join(cols, ", ")), nil
+	}
+	return "", ErrBadRequest(fmt.Sprintf("unknown partition kind %q", s.Kind))
+}
+
+func partitionLiterals(values []any) string {
+	return strings.Join(Map(values, partitionLiteral), ", ")
+}
+
+func partitionLiteral(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case PartitionBoundValue:
+		return string(v)
+	case time.Time:
+		return boundLiteral(v)
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(v)
+	default:
+		return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", "''") + "'"
+	}
+}
+
+var partitionKeyRe = regexp.MustCompile(`^(RANGE|LIST|HASH) \((.+)\)$`)
+
+var partitionColumnRe = regexp.MustCompile(`^(?:"[^"]+"|[a-z_][a-z0-9_$]*)$`)
+
+// partitionKey reads the kind and the columns of the partition key of parent, keys on expressions are not supported
+func partitionKey(ctx context.Context, con sqlx.QueryerContext, parent string) (kind PartitionKind, cols []string, oid int64, err error) {
+	var def sql.NullString
+	if err = con.QueryRowxContext(ctx, "SELECT pg_get_partkeydef($1::regclass), $1::regclass::oid::bigint", parent).Scan(&def, &oid); err != nil {
+		return
+	}
+	m := partitionKeyRe.FindStringSubmatch(def.String)
+	if m == nil {
+		err = ErrBadRequest(fmt.Sprintf("%s is not partitioned", parent))
+		return
+	}
+	cols = strings.Split(m[2], ", ")
+	for _, c := range cols {
+		if !partitionColumnRe.MatchString(c) {
+			err = ErrBadRequest(fmt.Sprintf("partition key %s of %s is not supported", m[2], parent))
+			return
+		}
+	}
+	kind = PartitionKind(strings.ToLower(m[1]))
+	return
+}
+
+func AttachPartition(log zerolog.Logger, con sq.BaseRunner, spec PartitionSpec) error {
+	return AttachPartitionCtx(context.Background(), log, con, spec)
+}
+
+// AttachPartitionCtx attaches the existing table spec.Name to spec.Parent. A CHECK constraint of the bound is
+// validated beforehand, without blocking writes, so the attach does not scan the table under lock. Rows of the
+// default partition falling into the bound are moved into the table, postgres refuses to attach otherwise.
+func AttachPartitionCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, spec PartitionSpec) (err error) {
+	ctx, span := startDBSpan(ctx, con, "ATTACH", spec.Parent)
+	defer func() { endSpan(span, err) }()
+	if err = DialectOf(con).Check(FeaturePartition); err != nil {
+		return
+	}
+	log = log.With().Str("parent", spec.Parent).Str("partition", spec.Name).Logger()
+
+	var cond string
+	if !spec.Default {
+		err = WithTxRunner(ctx, con, TxOptions{}, func(tx TxRunner) (err error) {
+			kind, cols, oid, err := partitionKey(ctx, tx, spec.Parent)
+			if err != nil {
+				return
+			}
+			if kind != spec.Kind {
+				return ErrBadRequest(fmt.Sprintf("%s is partitioned by %s, not %s", spec.Parent, kind, spec.Kind))
+			}
+			if cond, err = spec.check(cols, oid); err != nil {
+				return
+			}
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %[1]s DROP CONSTRAINT IF EXISTS %[2]s, ADD CONSTRAINT %[2]s CHECK (%[3]s) NOT VALID",
+				spec.Name, partitionCheckName(spec.Name), cond))
+			return
+		})
+		if err != nil {
+			log.Err(err).Msg("error add partition check")
+			return
+		}
+		// validating takes a lock letting writes through, unlike the scan of the attach
+		err = WithTxRunner(ctx, con, TxOptions{}, func(tx TxRunner) (err error) {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s VALIDATE CONSTRAINT %s", spec.Name, partitionCheckName(spec.Name)))
+			return
+		})
+		if err != nil {
+			log.Err(err).Msg("error validate partition check, rows outside of the bound")
+			_ = WithTxRunner(ctx, con, TxOptions{}, func(tx TxRunner) (err error) {
+				_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s", spec.Name, partitionCheckName(spec.Name)))
+				return
+			})
+			return
+		}
+	}
+
+	err = WithTxRunner(ctx, con, TxOptions{}, func(tx TxRunner) (err error) {
+		parts, err := Partitions(ctx, tx, spec.Parent)
+		if err != nil {
+			return
+		}
+		if i := IndexOf(parts, PartitionInfo.IsDefault); i >= 0 && !spec.Default {
+			if err = moveFromDefault(ctx, tx, parts[i].Table(), spec.Name, cond); err != nil {
+				return
+			}
+		}
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ATTACH PARTITION %s %s", spec.Parent, spec.Name, spec.Bound())); err != nil {
+			return
+		}
+		if !spec.Default {
+			// the partition constraint supersedes it
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", spec.Name, partitionCheckName(spec.Name)))
+		}
+		return
+	})
+	if err != nil {
+		log.Err(err).Msg("error attach partition")
+	}
+	return
+}
+
+func partitionCheckName(table string) string {
+	if _, short, ok := strings.Cut(table, "."); ok {
+		table = short
+	}
+	return table + "_bound_check"
+}
+
+// moveFromDefault moves the rows matching cond out of the default partition into the table, writes to the default
+// partition are blocked till the transaction ends so none can slip in before the attach
+func moveFromDefault(ctx context.Context, tx TxRunner, def, table, cond string) (err error) {
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("LOCK TABLE %s IN SHARE ROW EXCLUSIVE MODE", def)); err != nil {
+		return
+	}
+	var cols []string
+	err = selectContext(ctx, tx, &cols, `
+		SELECT quote_ident(attname) FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped
+		ORDER BY attnum`, table)
+	if err != nil {
+		return
+	}
+	list := strings.Join(cols, ", ")
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("WITH moved AS (DELETE FROM %s WHERE %s RETURNING %s) INSERT INTO %s (%s) SELECT %s FROM moved",
+		def, cond, list, table, list, list))
+	return
+}
+
+func DetachPartition(log zerolog.Logger, con sqlx.ExtContext, parent, name string, concurrently bool) error {
+	return DetachPartitionCtx(context.Background(), log, con, parent, name, concurrently)
+}
+
+// DetachPartitionCtx detaches the partition name, plain or schema qualified, from parent. Concurrently does not
+// block queries on parent, it cannot run inside a transaction nor when parent has a default partition.
+func DetachPartitionCtx(ctx context.Context, log zerolog.Logger, con sqlx.ExtContext, parent, name string, concurrently bool) (err error) {
+	ctx, span := startDBSpan(ctx, con, "DETACH", parent)
+	defer func() { endSpan(span, err) }()
+	parts, err := Partitions(ctx, con, parent)
+	if err != nil {
+		log.Err(err).Str("parent", parent).Msg("error list partitions")
+		return
+	}
+	i := IndexOf(parts, func(p PartitionInfo) bool { return p.Name == name || p.Table() == name })
+	if i < 0 {
+		return NewErr(http.StatusNotFound, fmt.Sprintf("%s is not a partition of %s", name, parent), nil)
+	}
+	query := fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", parent, parts[i].Table())
+	if concurrently {
+		if IndexOf(parts, PartitionInfo.IsDefault) >= 0 {
+			return ErrBadRequest(fmt.Sprintf("%s has a default partition, it cannot be detached from concurrently", parent))
+		}
+		query += " CONCURRENTLY"
+	}
+	if _, err = con.ExecContext(ctx, query); err != nil {
+		log.Err(err).Str("parent", parent).Str("partition", name).Msg("error detach partition")
+	}
+	return
+}
@@ -0,0 +1,196 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionInfoTimeRange(t *testing.T) {
+	for bound, want := range map[string][2]time.Time{
+		"FOR VALUES FROM ('2024-01-01 00:00:00+00') TO ('2024-02-01 00:00:00+00')": {
+			time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		"FOR VALUES FROM ('2024-01-01 08:00:00+08') TO ('2024-01-02 08:00:00+08')": {
+			time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		"FOR VALUES FROM ('2024-01-01') TO ('2024-01-08')": {
+			time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)},
+	} {
+		from, to, ok := PartitionInfo{Bound: bound}.timeRange()
+		assert.True(t, ok, bound)
+		assert.Equal(t, want[0], from, bound)
+		assert.Equal(t, want[1], to, bound)
+	}
+
+	for _, bound := range []string{"DEFAULT", "FOR VALUES IN ('a')", "FOR VALUES FROM (MINVALUE) TO ('2024-01-01')", "FOR VALUES FROM (1) TO (10)"} {
+		_, _, ok := PartitionInfo{Bound: bound}.timeRange()
+		assert.False(t, ok, bound)
+	}
+}
+
+func TestNewPartitionManager(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(fakeConnector{}), "pgx")
+	_, err := NewPartitionManager(zerolog.Nop(), db, PartitionManagerConfig{Parent: "events", Level: LevelHour})
+	assert.NotNil(t, err)
+	_, err = NewPartitionManager(zerolog.Nop(), sqlx.NewDb(sql.OpenDB(fakeConnector{}), "clickhouse"), PartitionManagerConfig{Parent: "events", Level: LevelDay})
+	assert.ErrorIs(t, err, ErrUnsupportedByDialect)
+
+	now := time.Date(2024, 3, 13, 15, 0, 0, 0, time.UTC) // a wednesday
+	for level, want := range map[AggLevel][]string{
+		LevelDay:   {"events_p20240313", "events_p20240314", "2024-03-10"},
+		LevelWeek:  {"events_p20240311", "events_p20240318", "2024-02-19"},
+		LevelMonth: {"events_p202403", "events_p202404", "2023-12-01"},
+	} {
+		p, err := NewPartitionManager(zerolog.Nop(), db, PartitionManagerConfig{Parent: "app.events", Level: level, Retention: 3, Ahead: 1})
+		assert.Nil(t, err)
+		p.now = func() time.Time { return now }
+		assert.Equal(t, "app", p.cfg.Schema)
+		assert.Equal(t, want[0], p.partitionName(p.periodStart(0)), level)
+		assert.Equal(t, want[1], p.partitionName(p.periodStart(1)), level)
+		assert.Equal(t, want[2], p.periodStart(-3).Format(DateFormat), level)
+	}
+}
+
+func TestPartitionManager(t *testing.T) {
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	_, err := db.Exec(`CREATE TABLE events (at timestamptz NOT NULL, name text) PARTITION BY RANGE (at);
+		CREATE SCHEMA archive`)
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	p, err := NewPartitionManager(zerolog.Nop(), db, PartitionManagerConfig{Parent: "events", Level: LevelDay, Ahead: 2, Retention: 1})
+	assert.Nil(t, err)
+	p.now = func() time.Time { return time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC) }
+	report, err := p.Maintain(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"public.events_p20240110", "public.events_p20240111", "public.events_p20240112"}, report.Created)
+
+	// nothing left to do
+	report, err = p.Maintain(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Created)
+
+	p.now = func() time.Time { return time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC) }
+	p.cfg.ArchiveSchema = "archive"
+	report, err = p.Maintain(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"public.events_p20240113", "public.events_p20240114"}, report.Created)
+	assert.Equal(t, []string{"public.events_p20240110"}, report.Archived)
+
+	parts, err := Partitions(ctx, db, "events")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"events_p20240111", "events_p20240112", "events_p20240113", "events_p20240114"},
+		Map(parts, func(p PartitionInfo) string { return p.Name }))
+	var archived int
+	assert.Nil(t, db.Get(&archived, "SELECT count(*) FROM pg_tables WHERE schemaname = 'archive'"))
+	assert.Equal(t, 1, archived)
+}
+
+func TestPartitionSpec(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for spec, want := range map[*PartitionSpec]string{
+		{Kind: PartitionRange, From: []any{PartitionMinValue}, To: []any{at}}: "FOR VALUES FROM (MINVALUE) TO ('2024-01-01 00:00:00+00')",
+		{Kind: PartitionRange, From: []any{1, "a"}, To: []any{1, "o'k"}}:      "FOR VALUES FROM (1, 'a') TO (1, 'o''k')",
+		{Kind: PartitionList, Values: []any{"eu", nil}}:                       "FOR VALUES IN ('eu', NULL)",
+		{Kind: PartitionHash, Modulus: 4, Remainder: 1}:                       "FOR VALUES WITH (MODULUS 4, REMAINDER 1)",
+		{Kind: PartitionList, Values: []any{true}, Default: true}:             "DEFAULT",
+	} {
+		assert.Equal(t, want, spec.Bound())
+	}
+
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS s.t_1 PARTITION OF s.t FOR VALUES FROM (10) TO (20)", CreateRangePartition[uint]("s.t_1", "s.t", 10, 20))
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS t_eu PARTITION OF t FOR VALUES IN ('eu')", CreateListPartition("t_eu", "t", "eu"))
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS t_0 PARTITION OF t FOR VALUES WITH (MODULUS 2, REMAINDER 0);\n"+
+		"CREATE TABLE IF NOT EXISTS t_1 PARTITION OF t FOR VALUES WITH (MODULUS 2, REMAINDER 1)", CreateHashPartitions("t", 2))
+}
+
+func TestPartitionSpecCheck(t *testing.T) {
+	for _, c := range []struct {
+		spec PartitionSpec
+		cols []string
+		want string
+	}{
+		{PartitionSpec{Kind: PartitionRange, From: []any{10}, To: []any{20}}, []string{"id"}, "id IS NOT NULL AND id >= 10 AND id < 20"},
+		{PartitionSpec{Kind: PartitionRange, From: []any{10}, To: []any{PartitionMaxValue}}, []string{"id"}, "id IS NOT NULL AND id >= 10"},
+		{PartitionSpec{Kind: PartitionRange, From: []any{1, "a"}, To: []any{1, "m"}}, []string{"a", "b"}, "a IS NOT NULL AND b IS NOT NULL AND (a, b) >= (1, 'a') AND (a, b) < (1, 'm')"},
+		{PartitionSpec{Kind: PartitionList, Values: []any{"eu", "us"}}, []string{"region"}, "region IS NOT NULL AND region IN ('eu', 'us')"},
+		{PartitionSpec{Kind: PartitionList, Values: []any{"eu", nil}}, []string{"region"}, "(region IS NULL OR region IN ('eu'))"},
+		{PartitionSpec{Kind: PartitionList, Values: []any{nil}}, []string{"region"}, "region IS NULL"},
+		{PartitionSpec{Kind: PartitionHash, Modulus: 4, Remainder: 3}, []string{"id"}, "satisfies_hash_partition(42, 4, 3, id)"},
+	} {
+		got, err := c.spec.check(c.cols, 42)
+		assert.Nil(t, err)
+		assert.Equal(t, c.want, got)
+	}
+
+	_, err := PartitionSpec{Kind: PartitionRange, From: []any{1}, To: []any{2}}.check([]string{"a", "b"}, 0)
+	assert.NotNil(t, err)
+	_, err = PartitionSpec{Kind: PartitionRange, From: []any{1, PartitionMinValue}, To: []any{2, 3}}.check([]string{"a", "b"}, 0)
+	assert.NotNil(t, err)
+	_, err = PartitionSpec{Kind: PartitionList, Values: []any{1}}.check([]string{"a", "b"}, 0)
+	assert.NotNil(t, err)
+}
+
+func TestPartitionAttach(t *testing.T) {
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	_, err := db.Exec(`CREATE TABLE orders (id int NOT NULL, region text) PARTITION BY LIST (region);
+		CREATE TABLE orders_other PARTITION OF orders DEFAULT;
+		INSERT INTO orders VALUES (1, 'eu'), (2, 'us'), (3, 'eu');
+		CREATE TABLE orders_eu (id int NOT NULL, region text);
+		CREATE TABLE items (id int NOT NULL) PARTITION BY HASH (id);`)
+	assert.Nil(t, err)
+	_, err = db.Exec(CreateHashPartitions("items", 3))
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	// a row outside the bound fails the validation and leaves the table as it was
+	_, err = db.Exec("INSERT INTO orders_eu VALUES (4, 'us')")
+	assert.Nil(t, err)
+	spec := PartitionSpec{Kind: PartitionList, Name: "orders_eu", Parent: "orders", Values: []any{"eu"}}
+	assert.NotNil(t, AttachPartitionCtx(ctx, LOG, db, spec))
+	var checks int
+	assert.Nil(t, db.Get(&checks, "SELECT count(*) FROM pg_constraint WHERE conname = 'orders_eu_bound_check'"))
+	assert.Equal(t, 0, checks)
+
+	_, err = db.Exec("DELETE FROM orders_eu")
+	assert.Nil(t, err)
+	assert.Nil(t, AttachPartitionCtx(ctx, LOG, db, spec))
+	var ids []int
+	assert.Nil(t, db.Select(&ids, "SELECT id FROM orders_eu ORDER BY id"))
+	assert.Equal(t, []int{1, 3}, ids)
+	assert.Nil(t, db.Select(&ids, "SELECT id FROM orders_other"))
+	assert.Equal(t, []int{2}, ids)
+
+	parts, err := Partitions(ctx, db, "orders")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"orders_eu", "orders_other"}, Map(parts, func(p PartitionInfo) string { return p.Name }))
+	assert.True(t, parts[1].IsDefault())
+	assert.Positive(t, parts[0].Size)
+
+	assert.NotNil(t, DetachPartitionCtx(ctx, LOG, db, "orders", "orders_eu", true))
+	assert.Nil(t, DetachPartitionCtx(ctx, LOG, db, "orders", "public.orders_eu", false))
+	var e Err
+	assert.True(t, errors.As(DetachPartitionCtx(ctx, LOG, db, "orders", "orders_eu", false), &e))
+	assert.Equal(t, http.StatusNotFound, e.Code)
+
+	// a detached hash partition goes back without a scan
+	assert.Nil(t, DetachPartitionCtx(ctx, LOG, db, "items", "items_1", true))
+	assert.Nil(t, AttachPartitionCtx(ctx, LOG, db, PartitionSpec{Kind: PartitionHash, Name: "items_1", Parent: "items", Modulus: 3, Remainder: 1}))
+	parts, err = Partitions(ctx, db, "items")
+	assert.Nil(t, err)
+	assert.Len(t, parts, 3)
+}
+
+func TestPartitionManagerConfigDefault(t *testing.T) {
+	cfg := PartitionManagerConfig{Parent: "app.events", Ahead: -1, Interval: -time.Minute}
+	cfg.SetDefault()
+	assert.Equal(t, "app", cfg.Schema)
+	assert.Equal(t, 3, cfg.Ahead)
+	assert.Equal(t, time.Hour, cfg.Interval)
+}
@@ -0,0 +1,285 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+)
+
+// QueryEvent describes one statement run through a LoggedRunner
+type QueryEvent struct {
+	// Op is exec, query, query_row, select or get
+	Op       string
+	Query    string
+	Args     []any
+	Start    time.Time
+	Duration time.Duration
+	// RowsAffected is only known for exec, -1 otherwise
+	RowsAffected int64
+	Err          error
+	// Caller is the file:line outside this package and the sql libraries that ran the statement,
+	// walking the stack is not free so it is only set when Hooks are configured or the statement is logged
+	Caller string
+}
+
+// QueryHook is called around every statement, the context returned by BeforeQuery is the one
+// the statement runs with and AfterQuery receives, e.g. to carry a span
+type QueryHook interface {
+	BeforeQuery(ctx context.Context, e *QueryEvent) context.Context
+	AfterQuery(ctx context.Context, e *QueryEvent)
+}
+
+type QueryLogConfig struct {
+	// SlowThreshold logs statements taking longer at warn level, default 200ms
+	SlowThreshold time.Duration
+	// SampleRate is the fraction of the other statements logged at debug level, 0 logs none
+	SampleRate float64
+	// RedactArgs turns the args into what is logged, default RedactArgs
+	RedactArgs func(args []any) []any
+	Hooks      []QueryHook
+}
+
+func (c *QueryLogConfig) SetDefault() {
+	if c.SlowThreshold == 0 {
+		c.SlowThreshold = 200 * time.Millisecond
+	}
+	if c.RedactArgs == nil {
+		c.RedactArgs = RedactArgs
+	}
+}
+
+// RedactArgs keeps numbers, bools and times and masks the rest, strings and bytes may hold personal data
+func RedactArgs(args []any) []any {
+	return Map(args, func(a any) any {
+		switch a.(type) {
+		case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, time.Time:
+			return a
+		default:
+			return fmt.Sprintf("<%T>", a)
+		}
+	})
+}
+
+type loggedConn interface {
+	sqlx.Ext
+	sqlx.ExtContext
+	QueryRow(query string, args ...any) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// LoggedRunner wraps a *sqlx.DB or *sqlx.Tx, it can be passed to every helper and to squirrel's RunWith
+// and logs the slow and sampled statements with their duration and caller. The duration of Query and Queryx
+// ends when the first results arrive, Select and Get, which the helpers use, include scanning the rows.
+// WithTxRunner hands its fn the transaction wrapped again with the same logger and hooks.
+type LoggedRunner struct {
+	log zerolog.Logger
+	con loggedConn
+	cfg QueryLogConfig
+}
+
+var (
+	_ sqlx.Ext        = (*LoggedRunner)(nil)
+	_ sqlx.ExtContext = (*LoggedRunner)(nil)
+	_ sq.StdSqlCtx    = (*LoggedRunner)(nil)
+)
+
+func NewLoggedRunner(log zerolog.Logger, con loggedConn, cfg QueryLogConfig) *LoggedRunner {
+	cfg.SetDefault()
+	return &LoggedRunner{log: log, con: con, cfg: cfg}
+}
+
+// Unwrap returns the wrapped *sqlx.DB or *sqlx.Tx, WithTx uses it to start transactions
+func (l *LoggedRunner) Unwrap() sq.BaseRunner {
+	return l.con
+}
+
+// wrap returns a LoggedRunner over con logging the way l does, WithTxRunner uses it for the transaction
+func (l *LoggedRunner) wrap(con loggedConn) *LoggedRunner {
+	return &LoggedRunner{log: l.log, con: con, cfg: l.cfg}
+}
+
+func (l *LoggedRunner) DriverName() string {
+	return l.con.DriverName()
+}
+
+func (l *LoggedRunner) Rebind(query string) string {
+	return l.con.Rebind(query)
+}
+
+func (l *LoggedRunner) BindNamed(query string, arg any) (string, []any, error) {
+	return l.con.BindNamed(query, arg)
+}
+
+func (l *LoggedRunner) Exec(query string, args ...any) (sql.Result, error) {
+	return l.ExecContext(context.Background(), query, args...)
+}
+
+func (l *LoggedRunner) ExecContext(ctx context.Context, query string, args ...any) (ret sql.Result, err error) {
+	ctx, e := l.before(ctx, "exec", query, args)
+	ret, err = l.con.ExecContext(ctx, query, args...)
+	if err == nil {
+		e.RowsAffected, _ = ret.RowsAffected()
+	}
+	l.after(ctx, e, err)
+	return
+}
+
+func (l *LoggedRunner) Query(query string, args ...any) (*sql.Rows, error) {
+	return l.QueryContext(context.Background(), query, args...)
+}
+
+func (l *LoggedRunner) QueryContext(ctx context.Context, query string, args ...any) (ret *sql.Rows, err error) {
+	ctx, e := l.before(ctx, "query", query, args)
+	ret, err = l.con.QueryContext(ctx, query, args...)
+	l.after(ctx, e, err)
+	return
+}
+
+func (l *LoggedRunner) Queryx(query string, args ...any) (*sqlx.Rows, error) {
+	return l.QueryxContext(context.Background(), query, args...)
+}
+
+func (l *LoggedRunner) QueryxContext(ctx context.Context, query string, args ...any) (ret *sqlx.Rows, err error) {
+	ctx, e := l.before(ctx, "query", query, args)
+	ret, err = l.con.QueryxContext(ctx, query, args...)
+	l.after(ctx, e, err)
+	return
+}
+
+func (l *LoggedRunner) QueryRow(query string, args ...any) *sql.Row {
+	return l.QueryRowContext(context.Background(), query, args...)
+}
+
+func (l *LoggedRunner) QueryRowContext(ctx context.Context, query string, args ...any) (ret *sql.Row) {
+	ctx, e := l.before(ctx, "query_row", query, args)
+	ret = l.con.QueryRowContext(ctx, query, args...)
+	l.after(ctx, e, ret.Err())
+	return
+}
+
+func (l *LoggedRunner) QueryRowx(query string, args ...any) *sqlx.Row {
+	return l.QueryRowxContext(context.Background(), query, args...)
+}
+
+func (l *LoggedRunner) QueryRowxContext(ctx context.Context, query string, args ...any) (ret *sqlx.Row) {
+	ctx, e := l.before(ctx, "query_row", query, args)
+	ret = l.con.QueryRowxContext(ctx, query, args...)
+	l.after(ctx, e, ret.Err())
+	return
+}
+
+func (l *LoggedRunner) Select(dest any, query string, args ...any) error {
+	return l.SelectContext(context.Background(), dest, query, args...)
+}
+
+// SelectContext is sqlx.SelectContext timing the query together with the scan of every row
+func (l *LoggedRunner) SelectContext(ctx context.Context, dest any, query string, args ...any) (err error) {
+	ctx, e := l.before(ctx, "select", query, args)
+	err = sqlx.SelectContext(ctx, l.con, dest, query, args...)
+	l.after(ctx, e, err)
+	return
+}
+
+func (l *LoggedRunner) Get(dest any, query string, args ...any) error {
+	return l.GetContext(context.Background(), dest, query, args...)
+}
+
+func (l *LoggedRunner) GetContext(ctx context.Context, dest any, query string, args ...any) (err error) {
+	ctx, e := l.before(ctx, "get", query, args)
+	err = sqlx.GetContext(ctx, l.con, dest, query, args...)
+	l.after(ctx, e, err)
+	return
+}
+
+func (l *LoggedRunner) before(ctx context.Context, op, query string, args []any) (context.Context, *QueryEvent) {
+	e := &QueryEvent{
+		Op:           op,
+		Query:        query,
+		Args:         args,
+		Start:        time.Now(),
+		RowsAffected: -1,
+	}
+	if len(l.cfg.Hooks) > 0 {
+		e.Caller = queryCaller()
+	}
+	for _, h := range l.cfg.Hooks {
+		ctx = h.BeforeQuery(ctx, e)
+	}
+	return ctx, e
+}
+
+func (l *LoggedRunner) after(ctx context.Context, e *QueryEvent, err error) {
+	e.Duration = time.Since(e.Start)
+	e.Err = err
+	for _, h := range l.cfg.Hooks {
+		h.AfterQuery(ctx, e)
+	}
+
+	var event *zerolog.Event
+	switch {
+	case e.Duration >= l.cfg.SlowThreshold:
+		event = l.log.Warn()
+	case l.cfg.SampleRate > 0 && rand.Float64() < l.cfg.SampleRate:
+		event = l.log.Debug()
+	default:
+		return
+	}
+	if e.Caller == "" {
+		// after is called from the same depth as before
+		e.Caller = queryCaller()
+	}
+	event.Str("op", e.Op).
+		Str("query", e.Query).
+		Interface("args", l.cfg.RedactArgs(e.Args)).
+		Dur("duration", e.Duration).
+		Int64("rows", e.RowsAffected).
+		Str("caller", e.Caller).
+		AnErr("error", e.Err).
+		Msg("query")
+}
+
+// queryCallerSkip are the frames of the sql libraries and this package, the caller is the first frame outside
+var queryCallerSkip = []string{
+	"github.com/causalfoundry/utils/util.",
+	"github.com/Masterminds/squirrel.",
+	"github.com/jmoiron/sqlx.",
+	"database/sql.",
+}
+
+// selectContext runs con's own SelectContext when it has one, on a LoggedRunner that times the scan as well
+func selectContext(ctx context.Context, con sqlx.QueryerContext, dest any, query string, args ...any) error {
+	if s, ok := con.(interface {
+		SelectContext(ctx context.Context, dest any, query string, args ...any) error
+	}); ok {
+		return s.SelectContext(ctx, dest, query, args...)
+	}
+	return sqlx.SelectContext(ctx, con, dest, query, args...)
+}
+
+func queryCaller() string {
+	pc := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(4, pc)])
+	first := ""
+	for {
+		f, more := frames.Next()
+		if first == "" && !strings.Contains(f.Function, "(*LoggedRunner)") {
+			first = fmt.Sprintf("%s:%d", f.File, f.Line)
+		}
+		internal := slices.ContainsFunc(queryCallerSkip, func(prefix string) bool { return strings.HasPrefix(f.Function, prefix) })
+		if !internal || strings.HasSuffix(f.File, "_test.go") {
+			return fmt.Sprintf("%s:%d", f.File, f.Line)
+		}
+		if !more {
+			return first
+		}
+	}
+}
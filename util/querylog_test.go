@@ -0,0 +1,174 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDriver answers every query with a single row holding 1 and every exec with 3 rows affected,
+// statements containing "slow" take 20ms, reading the row of a query containing "scan_delay" as well
+type fakeDriver struct{}
+type fakeConn struct{}
+type fakeStmt struct{ query string }
+type fakeRows struct{ done, slow bool }
+
+func (fakeDriver) Open(string) (driver.Conn, error)    { return fakeConn{}, nil }
+func (fakeConn) Prepare(q string) (driver.Stmt, error) { return fakeStmt{q}, nil }
+func (fakeConn) Close() error                          { return nil }
+func (fakeConn) Begin() (driver.Tx, error)             { return fakeConn{}, nil }
+func (fakeConn) Commit() error                         { return nil }
+func (fakeConn) Rollback() error                       { return nil }
+func (s fakeStmt) Close() error                        { return nil }
+func (s fakeStmt) NumInput() int                       { return -1 }
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	s.wait()
+	return driver.RowsAffected(3), nil
+}
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	s.wait()
+	return &fakeRows{slow: strings.Contains(s.query, "scan_delay")}, nil
+}
+func (s fakeStmt) wait() {
+	if strings.Contains(s.query, "slow") {
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+func (r *fakeRows) Columns() []string { return []string{"n"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	if r.slow {
+		time.Sleep(20 * time.Millisecond)
+	}
+	r.done, dest[0] = true, int64(1)
+	return nil
+}
+
+type recordHook struct {
+	events []QueryEvent
+}
+
+type hookKey struct{}
+
+func (h *recordHook) BeforeQuery(ctx context.Context, e *QueryEvent) context.Context {
+	return context.WithValue(ctx, hookKey{}, e.Query)
+}
+
+func (h *recordHook) AfterQuery(ctx context.Context, e *QueryEvent) {
+	if ctx.Value(hookKey{}) == e.Query {
+		h.events = append(h.events, *e)
+	}
+}
+
+func logLines(buf *bytes.Buffer) (ret []map[string]any) {
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		m := map[string]any{}
+		_ = json.Unmarshal([]byte(line), &m)
+		ret = append(ret, m)
+	}
+	return
+}
+
+func TestLoggedRunner(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(fakeConnector{}), "pgx")
+	buf := &bytes.Buffer{}
+	hook := &recordHook{}
+	l := NewLoggedRunner(zerolog.New(buf), db, QueryLogConfig{SlowThreshold: 10 * time.Millisecond, Hooks: []QueryHook{hook}})
+	ctx := context.Background()
+
+	var n int
+	assert.Nil(t, sqlx.GetContext(ctx, l, &n, "SELECT 1"))
+	assert.Equal(t, 1, n)
+	assert.Empty(t, buf.String(), "fast statements are not logged")
+
+	_, err := sq.Update("t").Set("name", "secret").Set("slow", 2).Where("id = ?", 5).RunWith(l).ExecContext(ctx)
+	assert.Nil(t, err)
+	lines := logLines(buf)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "warn", lines[0]["level"])
+	assert.Equal(t, "exec", lines[0]["op"])
+	assert.Equal(t, []any{"<string>", float64(2), float64(5)}, lines[0]["args"])
+	assert.Equal(t, float64(3), lines[0]["rows"])
+	assert.Contains(t, lines[0]["caller"], "querylog_test.go")
+
+	assert.Len(t, hook.events, 2)
+	assert.Equal(t, "query_row", hook.events[0].Op)
+	assert.Contains(t, hook.events[0].Caller, "querylog_test.go")
+	assert.Equal(t, int64(-1), hook.events[0].RowsAffected)
+	assert.GreaterOrEqual(t, hook.events[1].Duration, 20*time.Millisecond)
+
+	assert.Equal(t, PostgresDialect, DialectOf(l))
+	exist, err := ExistMCtx(ctx, LOG, l, "t", map[string]any{"id": 1})
+	assert.Nil(t, err)
+	assert.True(t, exist)
+}
+
+func TestLoggedRunnerSampling(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(fakeConnector{}), "pgx")
+	buf := &bytes.Buffer{}
+	l := NewLoggedRunner(zerolog.New(buf), db, QueryLogConfig{SampleRate: 1})
+	_, err := l.Exec("DELETE FROM t")
+	assert.Nil(t, err)
+	lines := logLines(buf)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "debug", lines[0]["level"])
+	assert.Equal(t, "DELETE FROM t", lines[0]["query"])
+}
+
+func TestLoggedRunnerScanAndTx(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(fakeConnector{}), "pgx")
+	buf := &bytes.Buffer{}
+	hook := &recordHook{}
+	l := NewLoggedRunner(zerolog.New(buf), db, QueryLogConfig{SlowThreshold: 10 * time.Millisecond, Hooks: []QueryHook{hook}})
+	ctx := context.Background()
+
+	// the query is fast, reading its rows is not
+	var ns []int
+	assert.Nil(t, selectContext(ctx, l, &ns, "SELECT scan_delay"))
+	assert.Equal(t, []int{1}, ns)
+	lines := logLines(buf)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "select", lines[0]["op"])
+	assert.Contains(t, lines[0]["caller"], "querylog_test.go")
+
+	hook.events = nil
+	assert.Nil(t, WithTxRunner(ctx, l, TxOptions{}, func(tx TxRunner) error {
+		assert.IsType(t, &LoggedRunner{}, tx)
+		_, err := tx.ExecContext(ctx, "UPDATE t SET n = 2")
+		return err
+	}))
+	assert.Len(t, hook.events, 1)
+	assert.Equal(t, "UPDATE t SET n = 2", hook.events[0].Query)
+
+	assert.Nil(t, WithTxRunner(ctx, db, TxOptions{}, func(tx TxRunner) error {
+		assert.IsType(t, &sqlx.Tx{}, tx)
+		return nil
+	}))
+}
+
+func TestRedactArgs(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, []any{1, true, now, nil, "<string>", "<[]uint8>"}, RedactArgs([]any{1, true, now, nil, "a", []byte("b")}))
+}
+
+type fakeConnector struct{}
+
+func (fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn{}, nil }
+func (fakeConnector) Driver() driver.Driver                        { return fakeDriver{} }
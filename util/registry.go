@@ -0,0 +1,61 @@
+package util
+
+import (
+	"strings"
+	"sync"
+)
+
+// tableRegistry holds the per table configs of RegisterAudit, RegisterVersion and RegisterSoftDelete.
+// Tables are keyed without quotes, lower cased and with the public schema dropped. An unqualified name
+// finds the table registered schema qualified and the other way around, unless that name is registered
+// in several schemas.
+type tableRegistry[C any] struct {
+	mu     sync.RWMutex
+	tables map[string]C
+}
+
+func newTableRegistry[C any]() *tableRegistry[C] {
+	return &tableRegistry[C]{tables: map[string]C{}}
+}
+
+func (r *tableRegistry[C]) register(table string, cfg C) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tables[registryKey(table)] = cfg
+}
+
+func (r *tableRegistry[C]) unregister(table string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tables, registryKey(table))
+}
+
+func (r *tableRegistry[C]) get(table string) (cfg C, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key := registryKey(table)
+	if cfg, ok = r.tables[key]; ok {
+		return
+	}
+	if _, name, qualified := strings.Cut(key, "."); qualified {
+		cfg, ok = r.tables[name]
+		return
+	}
+
+	found := 0
+	for k, c := range r.tables {
+		if _, name, qualified := strings.Cut(k, "."); qualified && name == key {
+			cfg, found = c, found+1
+		}
+	}
+	if found != 1 {
+		var zero C
+		return zero, false
+	}
+	return cfg, true
+}
+
+func registryKey(table string) string {
+	key := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(table), `"`, ""))
+	return strings.TrimPrefix(key, "public.")
+}
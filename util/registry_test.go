@@ -0,0 +1,50 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// registerTestTable registers cfg for table with register, and drops it from r when the test ends
+func registerTestTable[C any](t *testing.T, register func(string, C), r *tableRegistry[C], table string, cfg C) {
+	register(table, cfg)
+	t.Cleanup(func() { r.unregister(table) })
+}
+
+func TestTableRegistry(t *testing.T) {
+	r := newTableRegistry[int]()
+	r.register("common.product", 1)
+	r.register(`"Orders"`, 2)
+	r.register("public.users", 3)
+
+	for table, want := range map[string]int{
+		"common.product":   1,
+		"product":          1,
+		"orders":           2,
+		"app.orders":       2,
+		"users":            3,
+		"public.users":     3,
+		`"public"."users"`: 3,
+	} {
+		got, ok := r.get(table)
+		assert.True(t, ok, table)
+		assert.Equal(t, want, got, table)
+	}
+	for _, table := range []string{"other", "app.product", "product_x"} {
+		_, ok := r.get(table)
+		assert.False(t, ok, table)
+	}
+
+	// the bare name is ambiguous once it is registered in two schemas
+	r.register("archive.product", 4)
+	_, ok := r.get("product")
+	assert.False(t, ok)
+	got, _ := r.get("archive.product")
+	assert.Equal(t, 4, got)
+
+	r.unregister("Common.Product")
+	got, ok = r.get("product")
+	assert.True(t, ok)
+	assert.Equal(t, 4, got)
+}
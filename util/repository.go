@@ -0,0 +1,236 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+)
+
+type RepositoryConfig struct {
+	Table string
+	PKs   []string
+	// SoftDelete, when set, registers the soft delete column of Table with RegisterSoftDelete. Left nil,
+	// a registration made elsewhere still applies
+	SoftDelete *SoftDeleteConfig
+	// InsertSkip are columns left to the database on insert, e.g. serial ids or defaults
+	InsertSkip []string
+	// MergeStrategy is passed to UpdateClause when upserting
+	MergeStrategy map[string]string
+}
+
+// Repository binds the CRUD helpers to one table, the columns are discovered from the db tags of T.
+// A table registered with RegisterSoftDelete, or through RepositoryConfig.SoftDelete, is soft deleted by
+// Delete and its reads skip those rows.
+type Repository[T any] struct {
+	log  zerolog.Logger
+	con  sq.BaseRunner
+	cfg  RepositoryConfig
+	cols []string
+}
+
+func NewRepository[T any](log zerolog.Logger, con sq.BaseRunner, cfg RepositoryConfig) (Repository[T], error) {
+	if cfg.Table == "" {
+		return Repository[T]{}, errors.New("repository requires a table")
+	}
+	if len(cfg.PKs) == 0 {
+		return Repository[T]{}, errors.New("repository requires at least one primary key")
+	}
+
+	cols := StructTags(*new(T), "db", nil)
+	for _, pk := range cfg.PKs {
+		if !Contains(pk, cols) {
+			return Repository[T]{}, fmt.Errorf("primary key %s is not a db tag of %T", pk, *new(T))
+		}
+	}
+	sd, registered := softDeleteOf(cfg.Table)
+	if cfg.SoftDelete != nil {
+		want := *cfg.SoftDelete
+		want.SetDefault()
+		if registered && sd != want {
+			return Repository[T]{}, fmt.Errorf("%s is already registered to soft delete by %s", cfg.Table, sd.Column)
+		}
+		sd, registered = want, true
+	}
+	if registered && !Contains(sd.Column, cols) {
+		return Repository[T]{}, fmt.Errorf("soft delete column %s is not a db tag of %T", sd.Column, *new(T))
+	}
+	if cfg.SoftDelete != nil {
+		RegisterSoftDelete(cfg.Table, sd)
+	}
+
+	return Repository[T]{
+		log:  log,
+		con:  con,
+		cfg:  cfg,
+		cols: cols,
+	}, nil
+}
+
+// WithRunner returns a copy of the repository running on con, typically a *sqlx.Tx from EitherRunner
+func (r Repository[T]) WithRunner(con sq.BaseRunner) Repository[T] {
+	r.con = con
+	return r
+}
+
+func (r Repository[T]) Table() string {
+	return r.cfg.Table
+}
+
+func (r Repository[T]) Columns() []string {
+	return r.cols
+}
+
+func (r Repository[T]) queryer() (sqlx.QueryerContext, error) {
+	q, ok := r.con.(sqlx.QueryerContext)
+	if !ok {
+		return nil, fmt.Errorf("runner %T does not support context queries", r.con)
+	}
+	return q, nil
+}
+
+func (r Repository[T]) pkWhere(pk []any) (map[string]any, error) {
+	if len(pk) != len(r.cfg.PKs) {
+		return nil, fmt.Errorf("expect %d primary key values for %s, got %d", len(r.cfg.PKs), r.cfg.Table, len(pk))
+	}
+	where := make(map[string]any, len(pk))
+	for i, col := range r.cfg.PKs {
+		where[col] = pk[i]
+	}
+	return where, nil
+}
+
+// Create inserts t and returns the stored row, including generated columns
+func (r Repository[T]) Create(ctx context.Context, t T) (ret T, err error) {
+	q, err := r.queryer()
+	if err != nil {
+		return
+	}
+	d := DialectOf(r.con)
+	if err = d.Check(FeatureReturning); err != nil {
+		return
+	}
+	cols, vals := ExtractTags(t, "db", r.cfg.InsertSkip)
+	base := d.Builder().Insert(d.Ident(r.cfg.Table)).
+		Columns(d.Idents(cols)...).
+		Values(vals...)
+	if cfg, ok := auditOf(ctx, r.cfg.Table); ok {
+		return r.auditedCreate(ctx, cfg, base)
+	}
+	query, args, _ := base.
+		Suffix("RETURNING " + strings.Join(d.Idents(r.cols), ",")).
+		ToSql()
+	if err = q.QueryRowxContext(ctx, query, args...).StructScan(&ret); err != nil {
+		r.log.Err(err).Str("table", r.cfg.Table).Interface("req", t).Msg("error create")
+	}
+	return
+}
+
+// auditedCreate inserts through auditedInsert and reads the stored row back by its primary keys
+func (r Repository[T]) auditedCreate(ctx context.Context, cfg AuditConfig, base sq.InsertBuilder) (ret T, err error) {
+	after, err := auditedInsert(ctx, r.log, r.con, r.cfg.Table, cfg, base)
+	if err != nil {
+		return
+	}
+	if len(after) != 1 {
+		return ret, fmt.Errorf("expect 1 row created in %s, got %d", r.cfg.Table, len(after))
+	}
+	pk := make([]any, len(r.cfg.PKs))
+	for i, col := range r.cfg.PKs {
+		pk[i] = auditPKValue(after[0][col])
+	}
+	return r.Get(WithDeleted(ctx), pk...)
+}
+
+func (r Repository[T]) CreateMany(ctx context.Context, ts []T) error {
+	_, err := CreateManySkipCtx(ctx, r.log, r.con, r.cfg.Table, ts, nil, r.cfg.InsertSkip, nil)
+	return err
+}
+
+func (r Repository[T]) Get(ctx context.Context, pk ...any) (ret T, err error) {
+	where, err := r.pkWhere(pk)
+	if err != nil {
+		return
+	}
+	q, err := r.queryer()
+	if err != nil {
+		return
+	}
+	return GetMCtx[T](ctx, r.log, q, r.cfg.Table, where)
+}
+
+func (r Repository[T]) GetMany(ctx context.Context, where map[string]any, orderBy []string) (ret []T, err error) {
+	q, err := r.queryer()
+	if err != nil {
+		return
+	}
+	return GetManyMCtx[T](ctx, r.log, q, r.cfg.Table, where, orderBy)
+}
+
+func (r Repository[T]) List(ctx context.Context, page Page, where map[string]any, orderBy []string) (ret []T, total int, err error) {
+	q, err := r.queryer()
+	if err != nil {
+		return
+	}
+	return ListMCtx[T](ctx, r.log, q, page, r.cfg.Table, where, orderBy)
+}
+
+// Upsert inserts ts, rows conflicting on the primary keys are merged by the MergeStrategy
+func (r Repository[T]) Upsert(ctx context.Context, ts ...T) error {
+	return UpsertManyCtx(ctx, r.log, r.con, r.cfg.Table, r.cfg.PKs, "db", ts, r.cfg.MergeStrategy, nil)
+}
+
+func (r Repository[T]) Update(ctx context.Context, sets map[string]any, pk ...any) error {
+	where, err := r.pkWhere(pk)
+	if err != nil {
+		return err
+	}
+	return UpdateMCtx(ctx, r.log, r.con, r.cfg.Table, where, sets)
+}
+
+// Delete soft deletes the row when the table is registered with RegisterSoftDelete, otherwise it is removed
+func (r Repository[T]) Delete(ctx context.Context, pk ...any) (err error) {
+	where, err := r.pkWhere(pk)
+	if err != nil {
+		return
+	}
+	if _, ok := softDeleteOf(r.cfg.Table); ok {
+		return SoftDeleteCtx(ctx, r.log, r.con, r.cfg.Table, where)
+	}
+	if cfg, ok := auditOf(ctx, r.cfg.Table); ok {
+		return audited(ctx, r.log, r.con, r.cfg.Table, cfg, []sq.Sqlizer{sq.Eq(where)}, false, func(ctx context.Context, tx TxRunner) error {
+			return r.WithRunner(tx).Delete(ctx, pk...)
+		})
+	}
+	d := DialectOf(r.con)
+	if _, err = d.Builder().Delete(d.Ident(r.cfg.Table)).Where(sq.Eq(where)).RunWith(r.con).ExecContext(ctx); err != nil {
+		r.log.Err(err).Interface("where", where).Str("table", r.cfg.Table).Msg("error delete")
+	}
+	return
+}
+
+func (r Repository[T]) Exists(ctx context.Context, where map[string]any) (ret bool, err error) {
+	q, err := r.queryer()
+	if err != nil {
+		return
+	}
+	return ExistMCtx(ctx, r.log, q, r.cfg.Table, where)
+}
+
+func (r Repository[T]) Count(ctx context.Context, where map[string]any) (total int, err error) {
+	q, err := r.queryer()
+	if err != nil {
+		return
+	}
+	d := DialectOf(r.con)
+	b := d.Builder().Select("COUNT(*)").From(d.Ident(r.cfg.Table)).Where(sq.Eq(where))
+	query, args, _ := whereSoftDelete(b, softDeleteM(ctx, r.cfg.Table, where)).ToSql()
+	if err = q.QueryRowxContext(ctx, query, args...).Scan(&total); err != nil {
+		r.log.Err(err).Interface("where", where).Str("table", r.cfg.Table).Msg("error count")
+	}
+	return
+}
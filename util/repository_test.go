@@ -0,0 +1,122 @@
+package util
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type repoRow struct {
+	ID        int    `db:"id"`
+	Name      string `db:"name"`
+	IsDeleted bool   `db:"is_deleted"`
+}
+
+func TestNewRepository(t *testing.T) {
+	_, err := NewRepository[repoRow](zerolog.Logger{}, nil, RepositoryConfig{PKs: []string{"id"}})
+	assert.ErrorContains(t, err, "requires a table")
+
+	_, err = NewRepository[repoRow](zerolog.Logger{}, nil, RepositoryConfig{Table: "a"})
+	assert.ErrorContains(t, err, "at least one primary key")
+
+	_, err = NewRepository[repoRow](zerolog.Logger{}, nil, RepositoryConfig{Table: "a", PKs: []string{"uid"}})
+	assert.ErrorContains(t, err, "primary key uid")
+
+	registerTestTable(t, RegisterSoftDelete, softDeletes, "b", SoftDeleteConfig{Column: "deleted"})
+	_, err = NewRepository[repoRow](zerolog.Logger{}, nil, RepositoryConfig{Table: "b", PKs: []string{"id"}})
+	assert.ErrorContains(t, err, "soft delete column deleted")
+
+	_, err = NewRepository[repoRow](zerolog.Logger{}, nil, RepositoryConfig{Table: "c", PKs: []string{"id"}, SoftDelete: &SoftDeleteConfig{Column: "deleted"}})
+	assert.ErrorContains(t, err, "soft delete column deleted")
+	_, ok := softDeleteOf("c")
+	assert.False(t, ok)
+
+	_, err = NewRepository[repoRow](zerolog.Logger{}, nil, RepositoryConfig{Table: "b", PKs: []string{"id"}, SoftDelete: &SoftDeleteConfig{}})
+	assert.ErrorContains(t, err, "b is already registered to soft delete by deleted")
+
+	t.Cleanup(func() { softDeletes.unregister("c") })
+	_, err = NewRepository[repoRow](zerolog.Logger{}, nil, RepositoryConfig{Table: "c", PKs: []string{"id"}, SoftDelete: &SoftDeleteConfig{}})
+	assert.Nil(t, err)
+	sd, ok := softDeleteOf("c")
+	assert.True(t, ok)
+	assert.Equal(t, SoftDeleteConfig{Column: "is_deleted", Kind: SoftDeleteBool}, sd)
+	// the same config again, e.g. a second repository on the table
+	_, err = NewRepository[repoRow](zerolog.Logger{}, nil, RepositoryConfig{Table: "c", PKs: []string{"id"}, SoftDelete: &SoftDeleteConfig{}})
+	assert.Nil(t, err)
+
+	repo, err := NewRepository[repoRow](zerolog.Logger{}, nil, RepositoryConfig{Table: "a", PKs: []string{"id"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"id", "name", "is_deleted"}, repo.Columns())
+
+	_, err = repo.Get(context.Background(), 1, 2)
+	assert.ErrorContains(t, err, "expect 1 primary key values")
+}
+
+func TestRepositorySoftDelete(t *testing.T) {
+	t.Cleanup(func() { softDeletes.unregister("repo_sd") })
+	l, queries := recordQueries(t)
+	repo, err := NewRepository[repoRow](zerolog.Logger{}, l, RepositoryConfig{Table: "repo_sd", PKs: []string{"id"}, SoftDelete: &SoftDeleteConfig{}})
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	_, err = repo.Exists(ctx, map[string]any{"id": 1})
+	assert.Nil(t, err)
+	_, err = repo.Count(OnlyDeleted(ctx), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, repo.Delete(ctx, 1))
+	assert.Equal(t, []string{
+		"SELECT COUNT(*) FROM repo_sd WHERE id = $1 AND is_deleted = false",
+		"SELECT COUNT(*) FROM repo_sd WHERE (1=1) AND is_deleted = true",
+		"UPDATE repo_sd SET is_deleted = $1 WHERE id = $2 AND is_deleted = false",
+	}, queries())
+}
+
+func TestRepository(t *testing.T) {
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	_, err := db.Exec("CREATE TABLE repo (id serial primary key, name text, is_deleted bool not null default false)")
+	assert.Nil(t, err)
+
+	registerTestTable(t, RegisterSoftDelete, softDeletes, "repo", SoftDeleteConfig{})
+	repo, err := NewRepository[repoRow](zerolog.Logger{}, db, RepositoryConfig{
+		Table:      "repo",
+		PKs:        []string{"id"},
+		InsertSkip: []string{"id"},
+	})
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	created, err := repo.Create(ctx, repoRow{Name: "a"})
+	assert.Nil(t, err)
+	assert.Equal(t, repoRow{ID: 1, Name: "a"}, created)
+
+	assert.Nil(t, repo.CreateMany(ctx, []repoRow{{Name: "b"}, {Name: "c"}}))
+	assert.Nil(t, repo.Upsert(ctx, repoRow{ID: 2, Name: "bb"}))
+	assert.Nil(t, repo.Update(ctx, map[string]any{"name": "cc"}, 3))
+
+	got, err := repo.Get(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "bb", got.Name)
+
+	tx, err := db.Beginx()
+	assert.Nil(t, err)
+	assert.Nil(t, repo.WithRunner(tx).Delete(ctx, 1))
+	assert.Nil(t, tx.Commit())
+
+	_, err = repo.Get(ctx, 1)
+	assert.NotNil(t, err)
+
+	cnt, err := repo.Count(ctx, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cnt)
+
+	rows, total, err := repo.List(ctx, NoPagination, nil, []string{"id"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, []string{"bb", "cc"}, Map(rows, func(r repoRow) string { return r.Name }))
+
+	exists, err := repo.Exists(ctx, map[string]any{"name": "cc"})
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
@@ -0,0 +1,292 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/rs/zerolog"
+)
+
+type SoftDeleteKind string
+
+const (
+	// SoftDeleteBool flips a bool column, default is_deleted
+	SoftDeleteBool SoftDeleteKind = "bool"
+	// SoftDeleteTime sets a nullable timestamp column, default deleted_at, which allows purging by age
+	SoftDeleteTime SoftDeleteKind = "time"
+)
+
+type SoftDeleteConfig struct {
+	Column string
+	Kind   SoftDeleteKind
+}
+
+func (c *SoftDeleteConfig) SetDefault() {
+	if c.Kind == "" {
+		c.Kind = SoftDeleteBool
+	}
+	if c.Column == "" {
+		c.Column = "is_deleted"
+		if c.Kind == SoftDeleteTime {
+			c.Column = "deleted_at"
+		}
+	}
+}
+
+// live and deleted are the conditions selecting the rows kept and the rows soft deleted
+func (c SoftDeleteConfig) live() string {
+	if c.Kind == SoftDeleteTime {
+		return c.Column + " IS NULL"
+	}
+	return c.Column + " = false"
+}
+
+func (c SoftDeleteConfig) deleted() string {
+	if c.Kind == SoftDeleteTime {
+		return c.Column + " IS NOT NULL"
+	}
+	return c.Column + " = true"
+}
+
+// mark is the value of the column for a deleted or restored row
+func (c SoftDeleteConfig) mark(del bool) any {
+	if c.Kind == SoftDeleteBool {
+		return del
+	}
+	if del {
+		return time.Now().UTC()
+	}
+	return nil
+}
+
+var softDeletes = newTableRegistry[SoftDeleteConfig]()
+
+// RegisterSoftDelete makes the read helpers skip the soft deleted rows of table, call it at startup.
+// Reads filtering on the column themselves are left alone, see WithDeleted and OnlyDeleted for the others.
+func RegisterSoftDelete(table string, cfg SoftDeleteConfig) {
+	cfg.SetDefault()
+	softDeletes.register(table, cfg)
+}
+
+func softDeleteOf(table string) (SoftDeleteConfig, bool) {
+	return softDeletes.get(table)
+}
+
+type softDeleteScope int
+
+const (
+	scopeLive softDeleteScope = iota
+	scopeWithDeleted
+	scopeOnlyDeleted
+)
+
+type softDeleteScopeKey struct{}
+
+// WithDeleted marks ctx so the read helpers include the soft deleted rows
+func WithDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, softDeleteScopeKey{}, scopeWithDeleted)
+}
+
+// OnlyDeleted marks ctx so the read helpers return the soft deleted rows only, e.g. for a trash view
+func OnlyDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, softDeleteScopeKey{}, scopeOnlyDeleted)
+}
+
+// softDeleteWhere is the condition of the scope of ctx on table, empty when the table has no soft delete,
+// the scope includes everything or the caller filters on the column already
+func softDeleteWhere(ctx context.Context, table string, filtered func(col string) bool) string {
+	cfg, ok := softDeleteOf(table)
+	if !ok || filtered(cfg.Column) {
+		return ""
+	}
+	scope, _ := ctx.Value(softDeleteScopeKey{}).(softDeleteScope)
+	switch scope {
+	case scopeWithDeleted:
+		return ""
+	case scopeOnlyDeleted:
+		return cfg.deleted()
+	}
+	return cfg.live()
+}
+
+func softDeleteM(ctx context.Context, table string, where map[string]any) string {
+	return softDeleteWhere(ctx, table, func(col string) bool {
+		_, ok := where[col]
+		return ok
+	})
+}
+
+// softDeleteS returns wheres with the soft delete condition appended, the slice of the caller is not modified
+func softDeleteS(ctx context.Context, table string, wheres []string) []string {
+	cond := softDeleteWhere(ctx, table, func(col string) bool {
+		return slices.ContainsFunc(wheres, func(w string) bool { return referencesColumn(w, col) })
+	})
+	if cond == "" {
+		return wheres
+	}
+	return append(slices.Clip(wheres), cond)
+}
+
+// referencesColumn reports whether the sql condition where names col as a whole identifier, plain,
+// qualified or quoted. String literals are skipped, so neither is_deleted_at nor 'is_deleted' count.
+func referencesColumn(where, col string) bool {
+	for i := 0; i < len(where); {
+		switch c := where[i]; {
+		case c == '\'':
+			// '' inside a literal is an escaped quote, the loop just passes it as two literals
+			end := strings.IndexByte(where[i+1:], '\'')
+			if end < 0 {
+				return false
+			}
+			i += end + 2
+		case c == '"':
+			end := strings.IndexByte(where[i+1:], '"')
+			if end < 0 {
+				return false
+			}
+			if where[i+1:i+1+end] == col {
+				return true
+			}
+			i += end + 2
+		case isIdentByte(c):
+			j := i
+			for j < len(where) && isIdentByte(where[j]) {
+				j++
+			}
+			if strings.EqualFold(where[i:j], col) {
+				return true
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	return false
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func whereSoftDelete(b sq.SelectBuilder, cond string) sq.SelectBuilder {
+	if cond == "" {
+		return b
+	}
+	return b.Where(cond)
+}
+
+func mustSoftDelete(table string) (SoftDeleteConfig, error) {
+	cfg, ok := softDeleteOf(table)
+	if !ok {
+		return cfg, fmt.Errorf("table %s has no soft delete registered", table)
+	}
+	return cfg, nil
+}
+
+func SoftDelete(log zerolog.Logger, con sq.BaseRunner, table string, where map[string]any) (err error) {
+	return SoftDeleteCtx(context.Background(), log, con, table, where)
+}
+
+// SoftDeleteCtx marks the live rows of table matching where deleted
+func SoftDeleteCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, where map[string]any) (err error) {
+	return setSoftDeleted(ctx, log, con, table, where, true)
+}
+
+func Restore(log zerolog.Logger, con sq.BaseRunner, table string, where map[string]any) (err error) {
+	return RestoreCtx(context.Background(), log, con, table, where)
+}
+
+// RestoreCtx brings the soft deleted rows of table matching where back
+func RestoreCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, where map[string]any) (err error) {
+	return setSoftDeleted(ctx, log, con, table, where, false)
+}
+
+func setSoftDeleted(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, where map[string]any, del bool) (err error) {
+	cfg, err := mustSoftDelete(table)
+	if err != nil {
+		return
+	}
+	// only touch the rows changing state, so deleted_at keeps the time of the first delete
+	state := cfg.live()
+	if !del {
+		state = cfg.deleted()
+	}
+	if audit, ok := auditOf(ctx, table); ok {
+		return audited(ctx, log, con, table, audit, []sq.Sqlizer{sq.And{sq.Eq(where), sq.Expr(state)}}, false, func(ctx context.Context, tx TxRunner) error {
+			return setSoftDeleted(ctx, log, tx, table, where, del)
+		})
+	}
+
+	ctx, span := startDBSpan(ctx, con, "UPDATE", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	if err = d.Check(FeatureUpdate); err != nil {
+		return
+	}
+	q := d.Builder().Update(d.Ident(table)).
+		Set(cfg.Column, cfg.mark(del)).
+		Where(sq.Eq(where)).
+		Where(state)
+	spanStatement(span, q)
+	if _, err = q.RunWith(con).ExecContext(ctx); err != nil {
+		log.Err(err).Interface("where", where).Bool("del", del).Str("table", table).Msg("error set soft delete")
+	}
+	return
+}
+
+func Purge(log zerolog.Logger, con sq.BaseRunner, table string, where map[string]any) (int64, error) {
+	return PurgeCtx(context.Background(), log, con, table, where)
+}
+
+// PurgeCtx removes the soft deleted rows of table matching where for good, live rows are never removed
+func PurgeCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, where map[string]any) (n int64, err error) {
+	cfg, err := mustSoftDelete(table)
+	if err != nil {
+		return
+	}
+	return purge(ctx, log, con, table, sq.And{sq.Eq(where), sq.Expr(cfg.deleted())})
+}
+
+func PurgeOlderThan(log zerolog.Logger, con sq.BaseRunner, table string, age time.Duration) (int64, error) {
+	return PurgeOlderThanCtx(context.Background(), log, con, table, age)
+}
+
+// PurgeOlderThanCtx removes the rows of table soft deleted longer than age ago, for retention jobs.
+// It requires a SoftDeleteTime column.
+func PurgeOlderThanCtx(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, age time.Duration) (n int64, err error) {
+	cfg, err := mustSoftDelete(table)
+	if err != nil {
+		return
+	}
+	if cfg.Kind != SoftDeleteTime {
+		return 0, fmt.Errorf("purge older than requires a %s soft delete column on %s", SoftDeleteTime, table)
+	}
+	return purge(ctx, log, con, table, sq.Lt{cfg.Column: time.Now().UTC().Add(-age)})
+}
+
+func purge(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, where sq.Sqlizer) (n int64, err error) {
+	if audit, ok := auditOf(ctx, table); ok {
+		err = audited(ctx, log, con, table, audit, []sq.Sqlizer{where}, false, func(ctx context.Context, tx TxRunner) (err error) {
+			n, err = purge(ctx, log, tx, table, where)
+			return
+		})
+		return
+	}
+	ctx, span := startDBSpan(ctx, con, "DELETE", table)
+	defer func() { endSpan(span, err) }()
+	d := DialectOf(con)
+	q := d.Builder().Delete(d.Ident(table)).Where(where)
+	spanStatement(span, q)
+	res, err := q.RunWith(con).ExecContext(ctx)
+	if err != nil {
+		log.Err(err).Str("table", table).Msg("error purge")
+		return
+	}
+	n, _ = res.RowsAffected()
+	log.Info().Str("table", table).Int64("rows", n).Msg("purged soft deleted rows")
+	return
+}
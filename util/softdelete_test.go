@@ -0,0 +1,127 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func recordQueries(t *testing.T) (*LoggedRunner, func() []string) {
+	hook := &recordHook{}
+	db := sqlx.NewDb(sql.OpenDB(fakeConnector{}), "pgx")
+	l := NewLoggedRunner(zerolog.Nop(), db, QueryLogConfig{Hooks: []QueryHook{hook}})
+	return l, func() (ret []string) {
+		for _, e := range hook.events {
+			ret = append(ret, e.Query)
+		}
+		hook.events = nil
+		return
+	}
+}
+
+func TestSoftDeleteConfig(t *testing.T) {
+	cfg := SoftDeleteConfig{}
+	cfg.SetDefault()
+	assert.Equal(t, SoftDeleteConfig{Column: "is_deleted", Kind: SoftDeleteBool}, cfg)
+
+	cfg = SoftDeleteConfig{Kind: SoftDeleteTime}
+	cfg.SetDefault()
+	assert.Equal(t, "deleted_at", cfg.Column)
+	assert.Equal(t, "deleted_at IS NULL", cfg.live())
+	assert.Nil(t, cfg.mark(false))
+	assert.IsType(t, time.Time{}, cfg.mark(true))
+}
+
+func TestSoftDeleteReads(t *testing.T) {
+	type row struct {
+		N int `db:"n"`
+	}
+	registerTestTable(t, RegisterSoftDelete, softDeletes, "sd", SoftDeleteConfig{})
+	registerTestTable(t, RegisterSoftDelete, softDeletes, "sd_time", SoftDeleteConfig{Kind: SoftDeleteTime})
+	l, queries := recordQueries(t)
+	ctx := context.Background()
+
+	_, err := GetMCtx[row](ctx, LOG, l, "sd", map[string]any{"id": 1})
+	assert.Nil(t, err)
+	_, err = GetManyMCtx[row](WithDeleted(ctx), LOG, l, "sd", map[string]any{"id": 1}, nil)
+	assert.Nil(t, err)
+	_, err = ExistMCtx(OnlyDeleted(ctx), LOG, l, "sd_time", map[string]any{"id": 1})
+	assert.Nil(t, err)
+	// filtering on the column yourself wins
+	_, err = ExistMCtx(ctx, LOG, l, "sd", map[string]any{"is_deleted": true})
+	assert.Nil(t, err)
+	// other tables are untouched
+	_, err = ExistMCtx(ctx, LOG, l, "other", map[string]any{"id": 1})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"SELECT n FROM sd WHERE id = $1 AND is_deleted = false",
+		"SELECT n FROM sd WHERE id = $1 ORDER BY ",
+		"SELECT COUNT(*) FROM sd_time WHERE id = $1 AND deleted_at IS NOT NULL",
+		"SELECT COUNT(*) FROM sd WHERE is_deleted = $1",
+		"SELECT COUNT(*) FROM other WHERE id = $1",
+	}, queries())
+
+	wheres := make([]string, 1, 4)
+	wheres[0] = "id > 1"
+	_, _, err = ListSCtx[row](ctx, LOG, l, Page{Page: 0, PerPage: 10}, "sd_time", wheres, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", wheres[:2][1], "the slice of the caller is not written")
+	_, err = ExistSCtx(ctx, LOG, l, "sd", []string{"is_deleted = true"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"SELECT n FROM sd_time WHERE id > 1 AND deleted_at IS NULL ORDER BY 1 LIMIT 10 OFFSET 0",
+		"SELECT COUNT(*) FROM sd_time WHERE id > 1 AND deleted_at IS NULL",
+		"SELECT count(*) FROM sd WHERE is_deleted = true",
+	}, queries())
+}
+
+func TestReferencesColumn(t *testing.T) {
+	for where, want := range map[string]bool{
+		"is_deleted = true":                 true,
+		"t.is_deleted":                      true,
+		`"is_deleted" IS NULL`:              true,
+		"IS_DELETED = false":                true,
+		"(a = 1 OR is_deleted)":             true,
+		"is_deleted_at IS NULL":             false,
+		"not_is_deleted = 1":                false,
+		"name = 'is_deleted'":               false,
+		"name = 'it''s' AND is_deleted_x":   false,
+		"name = 'it''s' AND is_deleted = 1": true,
+	} {
+		assert.Equal(t, want, referencesColumn(where, "is_deleted"), where)
+	}
+}
+
+func TestSoftDeleteWrites(t *testing.T) {
+	registerTestTable(t, RegisterSoftDelete, softDeletes, "sd", SoftDeleteConfig{})
+	registerTestTable(t, RegisterSoftDelete, softDeletes, "sd_time", SoftDeleteConfig{Kind: SoftDeleteTime})
+	l, queries := recordQueries(t)
+	ctx := context.Background()
+
+	assert.Nil(t, SoftDeleteCtx(ctx, LOG, l, "sd", map[string]any{"id": 1}))
+	assert.Nil(t, RestoreCtx(ctx, LOG, l, "sd_time", map[string]any{"id": 1}))
+	assert.Nil(t, SetDeleteCtx(ctx, LOG, l, "sd_time", 1, true))
+	assert.Nil(t, SetDeleteCtx(ctx, LOG, l, "other", 1, true))
+	n, err := PurgeCtx(ctx, LOG, l, "sd", map[string]any{"id": 1})
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, n)
+	_, err = PurgeOlderThanCtx(ctx, LOG, l, "sd_time", 24*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"UPDATE sd SET is_deleted = $1 WHERE id = $2 AND is_deleted = false",
+		"UPDATE sd_time SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NOT NULL",
+		"UPDATE sd_time SET deleted_at = $1 WHERE id = $2",
+		"UPDATE other SET is_deleted = $1 WHERE id = $2",
+		"DELETE FROM sd WHERE (id = $1 AND is_deleted = true)",
+		"DELETE FROM sd_time WHERE deleted_at < $1",
+	}, queries())
+
+	_, err = PurgeOlderThanCtx(ctx, LOG, l, "sd", time.Hour)
+	assert.ErrorContains(t, err, "requires a time soft delete column")
+	assert.ErrorContains(t, RestoreCtx(ctx, LOG, l, "other", nil), "no soft delete registered")
+}
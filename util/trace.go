@@ -0,0 +1,164 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/causalfoundry/utils/util"
+
+// tracing is off until EnableTracing, the spans of the noop tracer cost next to nothing
+var (
+	tracerPtr  atomic.Pointer[trace.Tracer]
+	propagator = propagation.TraceContext{}
+)
+
+func init() {
+	EnableTracing(noop.NewTracerProvider())
+}
+
+// EnableTracing makes the helpers, Request/RequestCtx and TraceMiddleware create spans with tp,
+// it is safe to call while serving but the spans already started stay with the previous provider
+func EnableTracing(tp trace.TracerProvider) {
+	t := tp.Tracer(tracerName)
+	tracerPtr.Store(&t)
+}
+
+func tracer() trace.Tracer {
+	return *tracerPtr.Load()
+}
+
+var dbSystems = map[string]string{
+	PostgresDialect.Name:   "postgresql",
+	ClickhouseDialect.Name: "clickhouse",
+}
+
+// startDBSpan starts the span of a helper, end it with endSpan
+func startDBSpan(ctx context.Context, con any, op, table string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, op+" "+table,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", dbSystems[DialectOf(con).Name]),
+			attribute.String("db.operation", op),
+			attribute.String("db.sql.table", table),
+		))
+}
+
+// spanStatement records the statement, it is only rendered when the span is recorded
+func spanStatement(span trace.Span, s sq.Sqlizer) {
+	if !span.IsRecording() {
+		return
+	}
+	if query, _, err := s.ToSql(); err == nil {
+		span.SetAttributes(attribute.String("db.statement", query))
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startHTTPSpan starts the client span of an outbound request and injects its traceparent
+func startHTTPSpan(req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracer().Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("url.full", req.URL.Redacted()),
+		))
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req.WithContext(ctx), span
+}
+
+func endHTTPSpan(span trace.Span, status int, err error) {
+	if status != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 400 && err == nil {
+			err = fmt.Errorf("status %d", status)
+		}
+	}
+	endSpan(span, err)
+}
+
+// TraceLogger adds the trace and span id of ctx to log
+func TraceLogger(ctx context.Context, log zerolog.Logger) zerolog.Logger {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return log
+	}
+	return log.With().Str("trace_id", sc.TraceID().String()).Str("span_id", sc.SpanID().String()).Logger()
+}
+
+// TraceMiddleware continues the trace of the traceparent header in a server span per request,
+// the request context carries the span and log with the trace ids, see zerolog.Ctx
+func TraceMiddleware(log zerolog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			req := c.Request()
+			ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+			ctx, span := tracer().Start(ctx, req.Method+" "+c.Path(),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", req.Method),
+					attribute.String("http.route", c.Path()),
+					attribute.String("url.path", req.URL.Path),
+				))
+			ctx = TraceLogger(ctx, log).WithContext(ctx)
+			c.SetRequest(req.WithContext(ctx))
+
+			// a panicking handler still ends its span, the panic goes on to the recover middleware
+			defer func() {
+				p := recover()
+				if p != nil {
+					err = fmt.Errorf("panic: %v", p)
+				}
+				status := responseStatus(c, err)
+				span.SetAttributes(attribute.Int("http.response.status_code", status))
+				if err != nil {
+					span.RecordError(err)
+				}
+				if status >= 500 {
+					span.SetStatus(codes.Error, http.StatusText(status))
+				}
+				span.End()
+				if p != nil {
+					panic(p)
+				}
+			}()
+			return next(c)
+		}
+	}
+}
+
+// responseStatus is the status the error handler will write for err,
+// it writes the response after the middlewares returned
+func responseStatus(c echo.Context, err error) int {
+	var he *echo.HTTPError
+	var e Err
+	switch {
+	case errors.As(err, &he):
+		return he.Code
+	case errors.As(err, &e):
+		return e.Code
+	case err != nil && !c.Response().Committed:
+		return http.StatusInternalServerError
+	}
+	return c.Response().Status
+}
@@ -0,0 +1,148 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func enableTestTracing(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	old := tracerPtr.Load()
+	EnableTracing(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { tracerPtr.Store(old) })
+	return exporter
+}
+
+func spanAttrs(s tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	ret := map[attribute.Key]attribute.Value{}
+	for _, kv := range s.Attributes {
+		ret[kv.Key] = kv.Value
+	}
+	return ret
+}
+
+func TestTraceDB(t *testing.T) {
+	exporter := enableTestTracing(t)
+	db := sqlx.NewDb(sql.OpenDB(fakeConnector{}), "pgx")
+
+	type row struct {
+		N int `db:"n"`
+	}
+	got, err := GetMCtx[row](context.Background(), LOG, db, "t", map[string]any{"id": 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, got.N)
+	assert.Nil(t, UpdateMCtx(context.Background(), LOG, db, "t", map[string]any{"id": 1}, map[string]any{"n": 2}))
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "SELECT t", spans[0].Name)
+	assert.Equal(t, trace.SpanKindClient, spans[0].SpanKind)
+	attrs := spanAttrs(spans[0])
+	assert.Equal(t, "postgresql", attrs["db.system"].AsString())
+	assert.Equal(t, "t", attrs["db.sql.table"].AsString())
+	assert.Equal(t, "SELECT n FROM t WHERE id = $1", attrs["db.statement"].AsString())
+	assert.Equal(t, "UPDATE t SET n = $1 WHERE id = $2", spanAttrs(spans[1])["db.statement"].AsString())
+
+	// errors mark the span
+	ch := sqlx.NewDb(sql.OpenDB(fakeConnector{}), "clickhouse")
+	assert.NotNil(t, UpdateMCtx(context.Background(), LOG, ch, "t", nil, map[string]any{"n": 2}))
+	failed := exporter.GetSpans()[2]
+	assert.Equal(t, codes.Error, failed.Status.Code)
+	assert.Equal(t, "clickhouse", spanAttrs(failed)["db.system"].AsString())
+}
+
+func TestTraceRequest(t *testing.T) {
+	exporter := enableTestTracing(t)
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	_, err := RequestCtx[map[string]bool](http.MethodGet, srv.URL+"/ok", nil, nil, nil, context.Background())
+	assert.Nil(t, err)
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, trace.SpanKindClient, spans[0].SpanKind)
+	assert.Contains(t, traceparent, spans[0].SpanContext.TraceID().String())
+	assert.Contains(t, traceparent, spans[0].SpanContext.SpanID().String())
+	assert.Equal(t, int64(200), spanAttrs(spans[0])["http.response.status_code"].AsInt64())
+
+	_, err = Request[map[string]bool](http.MethodGet, srv.URL+"/fail", nil, nil, nil, 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, codes.Error, exporter.GetSpans()[1].Status.Code)
+}
+
+func TestTraceMiddleware(t *testing.T) {
+	exporter := enableTestTracing(t)
+	buf := &bytes.Buffer{}
+	e := echo.New()
+	e.HTTPErrorHandler = CustomErrHandler(e)
+	e.Use(TraceMiddleware(zerolog.New(buf)))
+	e.GET("/items/:id", func(c echo.Context) error {
+		zerolog.Ctx(c.Request().Context()).Info().Msg("handled")
+		return OkJSON(c, "ok")
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return NewErr(http.StatusServiceUnavailable, "down", nil)
+	})
+	e.GET("/panic", func(c echo.Context) error {
+		panic("boom")
+	})
+
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodGet, "/items/1", nil)
+	req.Header.Set("traceparent", parent)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "GET /items/:id", spans[0].Name)
+	assert.Equal(t, trace.SpanKindServer, spans[0].SpanKind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent.SpanID().String())
+	assert.Contains(t, buf.String(), `"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"`)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fail", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	failed := exporter.GetSpans()[1]
+	assert.Equal(t, int64(503), spanAttrs(failed)["http.response.status_code"].AsInt64())
+	assert.Equal(t, codes.Error, failed.Status.Code)
+
+	// the panic goes on, the span is ended all the same
+	assert.PanicsWithValue(t, "boom", func() {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/panic", nil))
+	})
+	panicked := exporter.GetSpans()[2]
+	assert.Equal(t, "GET /panic", panicked.Name)
+	assert.Equal(t, int64(500), spanAttrs(panicked)["http.response.status_code"].AsInt64())
+	assert.Equal(t, codes.Error, panicked.Status.Code)
+}
+
+func TestTraceDisabled(t *testing.T) {
+	_, span := startDBSpan(context.Background(), nil, "SELECT", "t")
+	assert.False(t, span.IsRecording())
+	assert.Equal(t, zerolog.Nop(), TraceLogger(context.Background(), zerolog.Nop()))
+}
@@ -0,0 +1,192 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// MaxAttempts bounds how often a transaction failing with a serialization failure
+	// or a deadlock is run again, 1 disables retrying
+	MaxAttempts int
+	// Backoff is the base wait between attempts, doubled on every retry with jitter,
+	// zero or negative is the default
+	Backoff time.Duration
+	// MaxBackoff caps the doubled Backoff, zero or negative is the default
+	MaxBackoff time.Duration
+}
+
+func (o *TxOptions) SetDefault() {
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 3
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = 50 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 5 * time.Second
+	}
+}
+
+// nextBackoff doubles backoff up to MaxBackoff
+func (o TxOptions) nextBackoff(backoff time.Duration) time.Duration {
+	if backoff >= o.MaxBackoff/2 {
+		return o.MaxBackoff
+	}
+	return backoff * 2
+}
+
+var savepointSeq atomic.Uint64
+
+// WithTx runs fn inside a transaction, committing when fn returns nil and rolling back otherwise.
+// con is usually the result of EitherRunner: on a *sqlx.DB a new transaction is started and
+// retried on SQLSTATE 40001/40P01, on a *sqlx.Tx fn runs inside a savepoint of the outer
+// transaction, and retrying is left to whoever owns it. A panic in fn rolls back and re-panics.
+func WithTx(ctx context.Context, con sq.BaseRunner, opts TxOptions, fn func(tx *sqlx.Tx) error) error {
+	switch c := con.(type) {
+	case *sqlx.Tx:
+		return withSavepoint(ctx, c, fn)
+	case *sqlx.DB:
+		return withRetry(ctx, c, opts, fn)
+	case interface{ Unwrap() sq.BaseRunner }:
+		return WithTx(ctx, c.Unwrap(), opts, fn)
+	default:
+		return fmt.Errorf("cannot start transaction on %T", con)
+	}
+}
+
+// TxRunner is the transaction WithTxRunner hands to fn
+type TxRunner interface {
+	sqlx.Ext
+	sqlx.ExtContext
+	QueryRow(query string, args ...any) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// WithTxRunner is WithTx handing fn the transaction wrapped the way con wraps its *sqlx.DB or *sqlx.Tx,
+// on a LoggedRunner the statements of fn are logged and go through the hooks like the ones outside
+func WithTxRunner(ctx context.Context, con sq.BaseRunner, opts TxOptions, fn func(tx TxRunner) error) error {
+	return WithTx(ctx, con, opts, func(tx *sqlx.Tx) error {
+		return fn(wrapTx(con, tx))
+	})
+}
+
+func wrapTx(con sq.BaseRunner, tx *sqlx.Tx) TxRunner {
+	switch c := con.(type) {
+	case *LoggedRunner:
+		return c.wrap(wrapTx(c.con, tx))
+	case interface{ Unwrap() sq.BaseRunner }:
+		return wrapTx(c.Unwrap(), tx)
+	default:
+		return tx
+	}
+}
+
+func withRetry(ctx context.Context, db *sqlx.DB, opts TxOptions, fn func(tx *sqlx.Tx) error) (err error) {
+	opts.SetDefault()
+	backoff := min(opts.Backoff, opts.MaxBackoff)
+	for attempt := 1; ; attempt++ {
+		err = runTx(ctx, db, opts, fn)
+		if err == nil || !IsRetryableTxErr(err) || attempt >= opts.MaxAttempts {
+			return
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(wait):
+		}
+		backoff = opts.nextBackoff(backoff)
+	}
+}
+
+func runTx(ctx context.Context, db *sqlx.DB, opts TxOptions, fn func(tx *sqlx.Tx) error) (err error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if err != nil {
+		return
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		if e := tx.Rollback(); e != nil && !errors.Is(e, sql.ErrTxDone) {
+			err = errors.Join(err, e)
+		}
+		return
+	}
+	return tx.Commit()
+}
+
+func withSavepoint(ctx context.Context, tx *sqlx.Tx, fn func(tx *sqlx.Tx) error) (err error) {
+	name := fmt.Sprintf("sp_%d", savepointSeq.Add(1))
+	if _, err = tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_, _ = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name)
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		if _, e := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); e != nil {
+			err = errors.Join(err, e)
+		}
+		return
+	}
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return
+}
+
+// IsRetryableTxErr reports serialization failures (40001) and deadlocks (40P01)
+func IsRetryableTxErr(err error) bool {
+	var code string
+	var pgErr *pgconn.PgError
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pgErr):
+		code = pgErr.Code
+	case errors.As(err, &pqErr):
+		code = string(pqErr.Code)
+	}
+	return code == "40001" || code == "40P01"
+}
+
+type RowLock string
+
+const (
+	LockWait       RowLock = ""
+	LockSkipLocked RowLock = "SKIP LOCKED"
+	LockNoWait     RowLock = "NOWAIT"
+)
+
+// GetForUpdate is GetM taking a row lock held until tx ends
+func GetForUpdate[T any](ctx context.Context, log zerolog.Logger, tx *sqlx.Tx, table string, where map[string]any, lock RowLock) (ret T, err error) {
+	if err = DialectOf(tx).Check(FeatureRowLock); err != nil {
+		return
+	}
+	suffix := "FOR UPDATE"
+	if lock != LockWait {
+		suffix += " " + string(lock)
+	}
+	return getM[T](ctx, log, tx, table, where, suffix)
+}
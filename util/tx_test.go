@@ -0,0 +1,122 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryableTxErr(t *testing.T) {
+	assert.True(t, IsRetryableTxErr(&pgconn.PgError{Code: "40001"}))
+	assert.True(t, IsRetryableTxErr(fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "40P01"})))
+	assert.True(t, IsRetryableTxErr(&pq.Error{Code: "40001"}))
+	assert.False(t, IsRetryableTxErr(&pgconn.PgError{Code: "23505"}))
+	assert.False(t, IsRetryableTxErr(errors.New("40001")))
+	assert.False(t, IsRetryableTxErr(nil))
+}
+
+func TestWithTxNegativeBackoff(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(fakeConnector{}), "pgx")
+	attempts := 0
+	err := WithTx(context.Background(), db, TxOptions{MaxAttempts: 2, Backoff: -time.Second}, func(tx *sqlx.Tx) error {
+		attempts++
+		return &pgconn.PgError{Code: "40001"}
+	})
+	assert.True(t, IsRetryableTxErr(err))
+	assert.Equal(t, 2, attempts)
+}
+
+func TestWithTx(t *testing.T) {
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	_, err := db.Exec("CREATE TABLE tx_test (id int primary key, val int)")
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	t.Run("nested rollback keeps outer work", func(t *testing.T) {
+		err := WithTx(ctx, db, TxOptions{}, func(tx *sqlx.Tx) error {
+			if _, err := tx.Exec("INSERT INTO tx_test VALUES (1, 1)"); err != nil {
+				return err
+			}
+			inner := WithTx(ctx, EitherRunner(tx, db), TxOptions{}, func(tx *sqlx.Tx) error {
+				_, _ = tx.Exec("INSERT INTO tx_test VALUES (2, 2)")
+				return errors.New("inner failed")
+			})
+			assert.ErrorContains(t, inner, "inner failed")
+			return nil
+		})
+		assert.Nil(t, err)
+
+		var ids []int
+		assert.Nil(t, db.Select(&ids, "SELECT id FROM tx_test ORDER BY id"))
+		assert.Equal(t, []int{1}, ids)
+	})
+
+	t.Run("panic rolls back", func(t *testing.T) {
+		assert.Panics(t, func() {
+			_ = WithTx(ctx, db, TxOptions{}, func(tx *sqlx.Tx) error {
+				_, _ = tx.Exec("INSERT INTO tx_test VALUES (3, 3)")
+				panic("boom")
+			})
+		})
+		exists, err := ExistMCtx(ctx, zerolog.Logger{}, db, "tx_test", map[string]any{"id": 3})
+		assert.Nil(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("retry serialization failure", func(t *testing.T) {
+		var attempts int
+		err := WithTx(ctx, db, TxOptions{Isolation: sql.LevelSerializable}, func(tx *sqlx.Tx) error {
+			attempts++
+			if attempts < 3 {
+				return &pgconn.PgError{Code: "40001"}
+			}
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("get for update", func(t *testing.T) {
+		err := WithTx(ctx, db, TxOptions{}, func(tx *sqlx.Tx) error {
+			row, err := GetForUpdate[struct {
+				ID  int `db:"id"`
+				Val int `db:"val"`
+			}](ctx, zerolog.Logger{}, tx, "tx_test", map[string]any{"id": 1}, LockNoWait)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, row.Val)
+
+			_, err = GetForUpdate[struct {
+				ID int `db:"id"`
+			}](ctx, zerolog.Logger{}, tx, "tx_test", map[string]any{"id": 9}, LockSkipLocked)
+			assert.Equal(t, http.StatusNotFound, err.(Err).Code)
+			return nil
+		})
+		assert.Nil(t, err)
+	})
+}
+
+func TestTxOptionsBackoff(t *testing.T) {
+	opts := TxOptions{Backoff: time.Second, MaxBackoff: -1}
+	opts.SetDefault()
+	assert.Equal(t, 5*time.Second, opts.MaxBackoff)
+
+	backoff := opts.Backoff
+	var waits []time.Duration
+	for range 100 {
+		backoff = opts.nextBackoff(backoff)
+		waits = append(waits, backoff)
+	}
+	assert.Equal(t, []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second}, waits[:3])
+	// doubling never overflows past the cap
+	assert.Equal(t, 5*time.Second, waits[99])
+}
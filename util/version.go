@@ -0,0 +1,138 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+type VersionKind string
+
+const (
+	// VersionCounter increments an integer column, default version
+	VersionCounter VersionKind = "counter"
+	// VersionTimestamp sets a timestamp column to the clock time, default updated_at
+	VersionTimestamp VersionKind = "timestamp"
+)
+
+type VersionConfig struct {
+	Column string
+	Kind   VersionKind
+}
+
+func (c *VersionConfig) SetDefault() {
+	if c.Kind == "" {
+		c.Kind = VersionCounter
+	}
+	if c.Column == "" {
+		c.Column = "version"
+		if c.Kind == VersionTimestamp {
+			c.Column = "updated_at"
+		}
+	}
+}
+
+// next is the SET of the column, clock_timestamp as now() would not move inside a transaction
+func (c VersionConfig) next() sq.Sqlizer {
+	if c.Kind == VersionTimestamp {
+		return sq.Expr("clock_timestamp()")
+	}
+	return sq.Expr(c.Column + " + 1")
+}
+
+// VersionConflict is the Data of the 409 Err of an update finding the row at another version
+type VersionConflict struct {
+	Version any `json:"version"`
+}
+
+var versions = newTableRegistry[VersionConfig]()
+
+// RegisterVersion makes UpdateM and UpdateWithID on table move the version column on every update,
+// and apply only to rows still at the version carried by IfVersion. An update finding no row at that
+// version fails with a 409 Err holding the current VersionConflict.
+func RegisterVersion(table string, cfg VersionConfig) {
+	cfg.SetDefault()
+	versions.register(table, cfg)
+}
+
+func versionOf(table string) (VersionConfig, bool) {
+	return versions.get(table)
+}
+
+type versionKey struct{}
+
+// IfVersion marks ctx so updates of versioned tables only apply to rows at version
+func IfVersion(ctx context.Context, version any) context.Context {
+	return context.WithValue(ctx, versionKey{}, version)
+}
+
+func expectedVersion(ctx context.Context) (any, bool) {
+	v := ctx.Value(versionKey{})
+	return v, v != nil
+}
+
+// versionConflict looks up the version the row is at, a row gone meanwhile is not found
+func versionConflict(ctx context.Context, log zerolog.Logger, con sq.BaseRunner, table string, where map[string]any, cfg VersionConfig) error {
+	var current any
+	d := DialectOf(con)
+	err := d.Builder().Select(d.Ident(cfg.Column)).From(d.Ident(table)).Where(where).
+		RunWith(con).QueryRowContext(ctx).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NewErr(http.StatusNotFound, "resource not found", nil)
+	}
+	if err != nil {
+		log.Err(err).Interface("where", where).Str("table", table).Msg("error get version")
+		return err
+	}
+	return NewErr(http.StatusConflict, fmt.Sprintf("%s was modified meanwhile", table), VersionConflict{Version: current})
+}
+
+// ETag renders a version as strong entity tag
+func ETag(version any) string {
+	if t, ok := version.(time.Time); ok {
+		return strconv.Quote(t.UTC().Format(time.RFC3339Nano))
+	}
+	return strconv.Quote(fmt.Sprint(version))
+}
+
+// SetETag sends the version of the resource, clients send it back in If-Match when updating it
+func SetETag(c echo.Context, version any) {
+	c.Response().Header().Set("ETag", ETag(version))
+}
+
+// IfMatch returns the context of the request carrying the version of its If-Match header, see IfVersion.
+// Without the header, or with *, the context is returned as it is and updates are not checked.
+func IfMatch(c echo.Context) (context.Context, error) {
+	ctx := c.Request().Context()
+	tag := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if tag == "" || tag == "*" {
+		return ctx, nil
+	}
+	raw, err := strconv.Unquote(strings.TrimPrefix(tag, "W/"))
+	if err != nil {
+		return ctx, ErrBadRequest(fmt.Sprintf("invalid If-Match: %s", tag))
+	}
+	if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return IfVersion(ctx, n), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return IfVersion(ctx, t), nil
+	}
+	return IfVersion(ctx, raw), nil
+}
+
+// setConflictETag sends the current version along a version conflict
+func setConflictETag(c echo.Context, e Err) {
+	if conflict, ok := e.Data.(VersionConflict); ok {
+		SetETag(c, conflict.Version)
+	}
+}
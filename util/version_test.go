@@ -0,0 +1,103 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionUpdate(t *testing.T) {
+	registerTestTable(t, RegisterVersion, versions, "v", VersionConfig{})
+	registerTestTable(t, RegisterVersion, versions, "v_time", VersionConfig{Kind: VersionTimestamp})
+	l, queries := recordQueries(t)
+	ctx := context.Background()
+
+	assert.Nil(t, UpdateWithIDCtx(ctx, LOG, l, "v", 1, map[string]any{"name": "a", "version": 9}))
+	assert.Nil(t, UpdateWithIDCtx(IfVersion(ctx, 2), LOG, l, "v", 1, map[string]any{"name": "a"}))
+	assert.Nil(t, UpdateMCtx(IfVersion(ctx, "x"), LOG, l, "v_time", map[string]any{"id": 1}, map[string]any{"name": "a"}))
+	assert.Nil(t, UpdateMCtx(IfVersion(ctx, 2), LOG, l, "other", map[string]any{"id": 1}, map[string]any{"name": "a"}))
+	assert.Equal(t, []string{
+		"UPDATE v SET name = $1, version = version + 1 WHERE id = $2",
+		"UPDATE v SET name = $1, version = version + 1 WHERE id = $2 AND version = $3",
+		"UPDATE v_time SET name = $1, updated_at = clock_timestamp() WHERE id = $2 AND updated_at = $3",
+		"UPDATE other SET name = $1 WHERE id = $2",
+	}, queries())
+}
+
+func TestETag(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.FixedZone("", 3600))
+	assert.Equal(t, `"3"`, ETag(int64(3)))
+	assert.Equal(t, `"2024-01-02T02:04:05.000006Z"`, ETag(at))
+
+	e := echo.New()
+	for header, want := range map[string]any{
+		`"3"`:                           int64(3),
+		`W/"3"`:                         int64(3),
+		`"2024-01-02T02:04:05.000006Z"`: at.UTC(),
+		`"abc"`:                         "abc",
+		"*":                             nil,
+		"":                              nil,
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/", nil)
+		req.Header.Set("If-Match", header)
+		ctx, err := IfMatch(e.NewContext(req, httptest.NewRecorder()))
+		assert.Nil(t, err)
+		got, _ := expectedVersion(ctx)
+		if tm, ok := got.(time.Time); ok {
+			assert.True(t, tm.Equal(want.(time.Time)), header)
+			continue
+		}
+		assert.Equal(t, want, got, header)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/", nil)
+	req.Header.Set("If-Match", "3")
+	_, err := IfMatch(e.NewContext(req, httptest.NewRecorder()))
+	var ae Err
+	assert.True(t, errors.As(err, &ae))
+	assert.Equal(t, http.StatusBadRequest, ae.Code)
+}
+
+func TestVersionConflictResponse(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = CustomErrHandler(e)
+	e.PUT("/", func(c echo.Context) error {
+		return NewErr(http.StatusConflict, "modified", VersionConflict{Version: int64(4)})
+	})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/", nil))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, `"4"`, rec.Header().Get("ETag"))
+
+	rec = httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodPut, "/", nil), rec)
+	assert.Nil(t, RespNoContent(c, NewErr(http.StatusConflict, "modified", VersionConflict{Version: int64(5)})))
+	assert.Equal(t, `"5"`, rec.Header().Get("ETag"))
+}
+
+func TestVersion(t *testing.T) {
+	db := PostgresTestDB(t, "", TestDBConfig{})
+	_, err := db.Exec("CREATE TABLE versioned (id int primary key, name text, version int not null default 1)")
+	assert.Nil(t, err)
+	_, err = db.Exec("INSERT INTO versioned (id, name) VALUES (1, 'a')")
+	assert.Nil(t, err)
+	registerTestTable(t, RegisterVersion, versions, "versioned", VersionConfig{})
+	ctx := context.Background()
+
+	assert.Nil(t, UpdateWithIDCtx(IfVersion(ctx, 1), LOG, db, "versioned", 1, map[string]any{"name": "b"}))
+	err = UpdateWithIDCtx(IfVersion(ctx, 1), LOG, db, "versioned", 1, map[string]any{"name": "c"})
+	var e Err
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusConflict, e.Code)
+	assert.EqualValues(t, 2, e.Data.(VersionConflict).Version)
+
+	err = UpdateWithIDCtx(IfVersion(ctx, 1), LOG, db, "versioned", 2, map[string]any{"name": "c"})
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusNotFound, e.Code)
+}